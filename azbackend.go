@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	log "github.com/sirupsen/logrus"
+)
+
+const azureStorageType = "azure"
+
+// azureBackend stores snapshots in an Azure Blob Storage container, the container takes the place of the bucket
+type azureBackend struct {
+	ctx       context.Context
+	client    *azblob.Client
+	container string
+	tier      *blob.AccessTier
+	metadata  map[string]*string
+}
+
+// newAzureBackend authenticates with the account key if set, then the SAS token, and falls back to the managed
+// identity of the host.
+func newAzureBackend(ctx context.Context, bc *backupConfig) (*azureBackend, error) {
+	log.WithFields(log.Fields{
+		"endpoint":    bc.Endpoint,
+		"account":     bc.AccountName,
+		"container":   bc.BucketName,
+		"endpoint-ca": bc.EndpointCA,
+		"folder":      bc.Folder,
+	}).Info("invoking set azure blob service client")
+
+	if len(bc.BucketName) == 0 {
+		return nil, fmt.Errorf("container is required for an azure storage target")
+	}
+	serviceURL := bc.Endpoint
+	if len(serviceURL) == 0 {
+		if len(bc.AccountName) == 0 {
+			return nil, fmt.Errorf("account name or endpoint is required for an azure storage target")
+		}
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", bc.AccountName)
+	} else if !strings.Contains(serviceURL, "://") {
+		serviceURL = fmt.Sprintf("https://%s", serviceURL)
+	}
+
+	opts := &azblob.ClientOptions{}
+	if bc.EndpointCA != "" {
+		tr, err := setTransportCA(http.DefaultTransport, bc.EndpointCA)
+		if err != nil {
+			return nil, err
+		}
+		opts.Transport = &http.Client{Transport: tr}
+	}
+
+	var client *azblob.Client
+	var err error
+	switch {
+	case len(bc.AccountKey) != 0:
+		var cred *azblob.SharedKeyCredential
+		cred, err = azblob.NewSharedKeyCredential(bc.AccountName, bc.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create azure shared key credential: %v", err)
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, opts)
+	case len(bc.SASToken) != 0:
+		client, err = azblob.NewClientWithNoCredential(fmt.Sprintf("%s?%s", serviceURL, strings.TrimPrefix(bc.SASToken, "?")), opts)
+	default:
+		log.Info("invoking set azure blob service client use managed identity")
+		miOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: policy.ClientOptions{Transport: opts.Transport}}
+		if len(bc.ClientID) != 0 {
+			miOpts.ID = azidentity.ClientID(bc.ClientID)
+		}
+		var cred azcore.TokenCredential
+		cred, err = azidentity.NewManagedIdentityCredential(miOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create azure managed identity credential: %v", err)
+		}
+		client, err = azblob.NewClient(serviceURL, cred, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure blob client: %v", err)
+	}
+
+	err = withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		_, err := client.ServiceClient().NewContainerClient(bc.BucketName).GetProperties(ctx, nil)
+		return err
+	})
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return nil, fmt.Errorf("container %s is not found", bc.BucketName)
+		}
+		return nil, fmt.Errorf("failed to check azure container:%s, err:%v", bc.BucketName, err)
+	}
+
+	a := &azureBackend{ctx: ctx, client: client, container: bc.BucketName, metadata: map[string]*string{}}
+	for k, v := range snapshotMetadata(bc) {
+		a.metadata[k] = stringPtr(v)
+	}
+	if len(bc.StorageClass) != 0 {
+		tier := blob.AccessTier(bc.StorageClass)
+		a.tier = &tier
+	}
+	return a, nil
+}
+
+func (a *azureBackend) Put(key, filePath string) error {
+	sum, err := snapshotChecksum(filePath)
+	if err != nil {
+		return permanent(fmt.Errorf("failed to compute checksum of [%s]: %v", filePath, err))
+	}
+	metadata := map[string]*string{checksumMetadata: stringPtr(sum)}
+	for k, v := range a.metadata {
+		metadata[k] = v
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return withTimeout(a.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		_, err := a.client.UploadFile(ctx, a.container, key, file, &azblob.UploadFileOptions{
+			AccessTier:  a.tier,
+			HTTPHeaders: &blob.HTTPHeaders{BlobContentType: stringPtr(contentType)},
+			Metadata:    metadata,
+			// Azure rejects every block whose body doesn't match its CRC64
+			TransactionalValidation: blob.TransferValidationTypeComputeCRC64(),
+		})
+		return err
+	})
+}
+
+func (a *azureBackend) VerifiesUploads() bool {
+	return true
+}
+
+func (a *azureBackend) PutStream(key string, r io.Reader) error {
+	return withTimeout(a.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		_, err := a.client.UploadStream(ctx, a.container, key, r, &azblob.UploadStreamOptions{
+			BlockSize:   streamPartSize,
+			AccessTier:  a.tier,
+			HTTPHeaders: &blob.HTTPHeaders{BlobContentType: stringPtr(contentType)},
+			Metadata:    a.metadata,
+		})
+		return err
+	})
+}
+
+func (a *azureBackend) SetChecksum(key, sum string) error {
+	// Setting metadata replaces all of it
+	metadata := map[string]*string{checksumMetadata: stringPtr(sum)}
+	for k, v := range a.metadata {
+		metadata[k] = v
+	}
+	return withTimeout(a.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		_, err := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(key).SetMetadata(ctx, metadata, nil)
+		return err
+	})
+}
+
+// Get downloads to a temporary file next to filePath, which is renamed once the download is complete. DownloadFile
+// needs the file upfront, so a missing blob or a failed download would otherwise leave a snapshot file behind.
+func (a *azureBackend) Get(key, filePath string) error {
+	localFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return fmt.Errorf("Failed to create local file [%s]: %w", filePath, err)
+	}
+	defer os.Remove(localFile.Name())
+
+	err = withTimeout(a.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		_, err := a.client.DownloadFile(ctx, a.container, key, localFile, nil)
+		return err
+	})
+	if cerr := localFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return errObjectNotFound
+		}
+		return fmt.Errorf("Failed to download blob to local file [%s]: %w", filePath, err)
+	}
+	return os.Rename(localFile.Name(), filePath)
+}
+
+func (a *azureBackend) GetRange(key string, offset int64, w io.Writer) error {
+	err := withTimeout(a.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		resp, err := a.client.DownloadStream(ctx, a.container, key, &azblob.DownloadStreamOptions{
+			Range: blob.HTTPRange{Offset: offset},
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(w, resp.Body)
+		return err
+	})
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+func (a *azureBackend) List(prefix string, recursive bool, fn func(objectInfo) error) error {
+	pager := a.client.NewListBlobsFlatPager(a.container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		var page azblob.ListBlobsFlatResponse
+		err := withTimeout(a.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			var err error
+			page, err = pager.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			// Blob names are flat, treat slashes after the prefix as sub folders like s3 does
+			if !recursive && strings.Contains(strings.TrimPrefix(*item.Name, prefix), "/") {
+				continue
+			}
+			info := objectInfo{Key: *item.Name}
+			if item.Properties != nil {
+				if item.Properties.ContentLength != nil {
+					info.Size = *item.Properties.ContentLength
+				}
+				if item.Properties.LastModified != nil {
+					info.LastModified = *item.Properties.LastModified
+				}
+				if item.Properties.ETag != nil {
+					info.ETag = string(*item.Properties.ETag)
+				}
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *azureBackend) Delete(key string) error {
+	err := withTimeout(a.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		_, err := a.client.DeleteBlob(ctx, a.container, key, nil)
+		return err
+	})
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (a *azureBackend) Stat(key string) (objectInfo, error) {
+	var props blob.GetPropertiesResponse
+	err := withTimeout(a.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		props, err = a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(key).GetProperties(ctx, nil)
+		return err
+	})
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return objectInfo{}, errObjectNotFound
+		}
+		return objectInfo{}, err
+	}
+	info := objectInfo{Key: key}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.LastModified = *props.LastModified
+	}
+	if props.ETag != nil {
+		info.ETag = string(*props.ETag)
+	}
+	metadata := map[string]string{}
+	for k, v := range props.Metadata {
+		if v != nil {
+			metadata[k] = *v
+		}
+	}
+	info.Metadata = normalizeMetadata(metadata)
+	return info, nil
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
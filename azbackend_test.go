@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// The well-known account of Azurite
+const (
+	azuriteAccountName = "devstoreaccount1"
+	azuriteAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// TestAzureBackend runs against Azurite, with AZURITE_BLOB_ENDPOINT set to its blob endpoint like
+// http://127.0.0.1:10000/devstoreaccount1
+func TestAzureBackend(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("AZURITE_BLOB_ENDPOINT is not set")
+	}
+	ctx := context.Background()
+	cred, err := azblob.NewSharedKeyCredential(azuriteAccountName, azuriteAccountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := azblob.NewClientWithSharedKeyCredential(endpoint, cred, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := "rke-tools-test"
+	if _, err := client.CreateContainer(ctx, container, nil); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	t.Cleanup(func() {
+		client.DeleteContainer(ctx, container, nil)
+	})
+
+	bc := &backupConfig{
+		Type:        azureStorageType,
+		Endpoint:    endpoint,
+		AccountName: azuriteAccountName,
+		AccountKey:  azuriteAccountKey,
+		BucketName:  container,
+		ClusterID:   "1a2b3c",
+	}
+	backend, err := newAzureBackend(ctx, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageBackend(t, backend, bc)
+
+	missing := *bc
+	missing.BucketName = "missing"
+	if _, err := newAzureBackend(ctx, &missing); err == nil {
+		t.Error("creating a backend for a missing container succeeded")
+	}
+}
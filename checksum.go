@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// checksumMetadata holds the hex SHA-256 of the uploaded snapshot. Backends without metadata keep it in a sidecar in
+	// sha256sum format, like the one next to local snapshots.
+	checksumMetadata  = "rke_sha256"
+	checksumExtension = "sha256"
+	checksumHeader    = "X-Checksum-Sha256"
+)
+
+// checksumPath returns the hidden file next to the snapshot that holds its checksum in sha256sum format
+func checksumPath(filePath string) string {
+	dir, file := filepath.Split(filePath)
+	return fmt.Sprintf("%s.%s.%s", dir, file, checksumExtension)
+}
+
+// checksumLine returns sum in sha256sum format for the file name
+func checksumLine(sum, name string) []byte {
+	return []byte(fmt.Sprintf("%s  %s\n", sum, name))
+}
+
+// parseChecksumLine returns the checksum in data in sha256sum format, or an empty string if there is none
+func parseChecksumLine(data []byte) string {
+	if fields := strings.Fields(string(data)); len(fields) != 0 {
+		return strings.ToLower(fields[0])
+	}
+	return ""
+}
+
+func writeChecksum(filePath, sum string) error {
+	if err := os.WriteFile(checksumPath(filePath), checksumLine(sum, filepath.Base(filePath)), 0600); err != nil {
+		return fmt.Errorf("failed to write checksum of [%s]: %v", filePath, err)
+	}
+	return nil
+}
+
+// snapshotChecksum returns the checksum written when the snapshot was archived, and computes it for snapshots without
+// one or modified since
+func snapshotChecksum(filePath string) (string, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	sumPath := checksumPath(filePath)
+	if sfi, err := os.Stat(sumPath); err == nil && !sfi.ModTime().Before(fi.ModTime()) {
+		if data, err := os.ReadFile(sumPath); err == nil {
+			if sum := parseChecksumLine(data); len(sum) != 0 {
+				return sum, nil
+			}
+		}
+	}
+	return fileSHA256(filePath)
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadMetadata returns metadata with the checksum of the snapshot at filePath added
+func uploadMetadata(metadata map[string]string, filePath string) (map[string]string, error) {
+	sum, err := snapshotChecksum(filePath)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to compute checksum of [%s]: %v", filePath, err))
+	}
+	m := map[string]string{checksumMetadata: sum}
+	for k, v := range metadata {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// verifyUpload checks the size and the stored checksum of the object uploaded from filePath. Backends that don't have
+// the storage service check every upload request, see verifyingBackend, are read back to compare the checksum of the
+// content as well.
+func verifyUpload(backend storageBackend, key, filePath string) error {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	info, err := backend.Stat(key)
+	if err != nil {
+		return fmt.Errorf("failed to stat uploaded [%s]: %w", key, err)
+	}
+	if info.Size != fi.Size() {
+		return fmt.Errorf("uploaded [%s] has size %d, expected %d", key, info.Size, fi.Size())
+	}
+	local, err := snapshotChecksum(filePath)
+	if err != nil {
+		return err
+	}
+	stored, ok := info.Metadata[checksumMetadata]
+	if !ok {
+		return fmt.Errorf("uploaded [%s] has no checksum stored", key)
+	}
+	if strings.ToLower(stored) != local {
+		return fmt.Errorf("uploaded [%s] has checksum %s stored, expected %s", key, stored, local)
+	}
+	if vb, ok := backend.(verifyingBackend); ok && vb.VerifiesUploads() {
+		return nil
+	}
+	rb, ok := backend.(rangeBackend)
+	if !ok {
+		log.Warnf("Storage target can't read back [%s], skipping checksum verification of the upload", key)
+		return nil
+	}
+	h := sha256.New()
+	if err := rb.GetRange(key, 0, h); err != nil {
+		return fmt.Errorf("failed to read back uploaded [%s]: %w", key, err)
+	}
+	if remote := hex.EncodeToString(h.Sum(nil)); remote != local {
+		return fmt.Errorf("uploaded [%s] has checksum %s, expected %s", key, remote, local)
+	}
+	log.Infof("Verified checksum of uploaded [%s]", key)
+	return nil
+}
+
+// verifyDownload compares the file downloaded from key with the checksum stored on upload. On a mismatch the file is
+// removed. Snapshots uploaded by older versions without a checksum are only logged.
+func verifyDownload(backend storageBackend, key, filePath string) error {
+	info, err := backend.Stat(key)
+	if err != nil {
+		return fmt.Errorf("failed to stat [%s]: %w", key, err)
+	}
+	expected, ok := info.Metadata[checksumMetadata]
+	if !ok {
+		log.Warnf("No checksum stored for [%s], skipping verification", key)
+		return nil
+	}
+	return verifyChecksum(filePath, expected)
+}
+
+// verifyChecksum removes filePath and fails if its SHA-256 isn't expected
+func verifyChecksum(filePath, expected string) error {
+	actual, err := fileSHA256(filePath)
+	if err != nil {
+		return err
+	}
+	if actual != strings.ToLower(expected) {
+		os.Remove(filePath)
+		log.WithFields(log.Fields{
+			"file":     filePath,
+			"expected": expected,
+			"actual":   actual,
+		}).Error("Checksum mismatch, removed the file")
+		return fmt.Errorf("checksum mismatch for [%s]: expected %s, got %s", filePath, expected, actual)
+	}
+	log.Infof("Verified checksum of [%s]", filePath)
+	return nil
+}
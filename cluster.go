@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Azure only allows C# identifiers as metadata names, so no dashes
+	clusterIDMetadata   = "rke_cluster_id"
+	clusterNameMetadata = "rke_cluster_name"
+
+	unownedReason = "no cluster metadata"
+	// ownerExtension is the sidecar holding the cluster metadata in backends without object metadata
+	ownerExtension = "owner"
+)
+
+var clusterNameFlag = cli.StringFlag{
+	Name:   "cluster-name",
+	Usage:  "Name of the cluster, stored with uploaded snapshots so retention leaves snapshots of other clusters alone",
+	EnvVar: "CLUSTER_NAME",
+}
+
+var adoptUnownedFlag = cli.BoolFlag{
+	Name:   "adopt-unowned",
+	Usage:  "Apply retention to snapshots without cluster metadata, uploaded by older versions or while the cluster id was unknown",
+	EnvVar: "ADOPT_UNOWNED",
+}
+
+var clusterIDFlag = cli.StringFlag{
+	Name:   "cluster-id",
+	Usage:  "Etcd cluster id (in hex) of the cluster, to leave snapshots of other clusters alone",
+	EnvVar: "ETCD_CLUSTER_ID",
+}
+
+type etcdEndpointStatus struct {
+	Status struct {
+		Header struct {
+			ClusterID uint64 `json:"cluster_id"`
+		} `json:"header"`
+	} `json:"Status"`
+}
+
+// etcdClusterID returns the id of the etcd cluster in hex, like etcdctl prints it in tables
+func etcdClusterID(ctx context.Context, endpoints, etcdCACert, etcdCert, etcdKey string) (string, error) {
+	var data []byte
+	err := withTimeout(ctx, etcdOperation, timeouts.Etcd, func(ctx context.Context) error {
+		var err error
+		data, err = exec.CommandContext(ctx, "etcdctl",
+			fmt.Sprintf("--endpoints=%s", endpoints),
+			"--cacert="+etcdCACert,
+			"--cert="+etcdCert,
+			"--key="+etcdKey,
+			"endpoint", "status", "-w", "json").Output()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get etcd endpoint status: %v", err)
+	}
+	var statuses []etcdEndpointStatus
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return "", fmt.Errorf("failed to parse etcd endpoint status: %v", err)
+	}
+	if len(statuses) == 0 || statuses[0].Status.Header.ClusterID == 0 {
+		return "", fmt.Errorf("etcd endpoint status has no cluster id")
+	}
+	return fmt.Sprintf("%x", statuses[0].Status.Header.ClusterID), nil
+}
+
+// lookupClusterID returns the etcd cluster id, or an empty string when etcd can't tell. Retention is then only
+// scoped by the cluster name, if set.
+func lookupClusterID(ctx context.Context, endpoints, etcdCACert, etcdCert, etcdKey string) string {
+	clusterID, err := etcdClusterID(ctx, endpoints, etcdCACert, etcdCert, etcdKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Error while trying to get the etcd cluster id")
+	}
+	return clusterID
+}
+
+// setClusterOwner records the cluster on the targets, so uploads carry it and retention is scoped to it
+func setClusterOwner(targets []*backupConfig, clusterID, clusterName string) {
+	for _, target := range targets {
+		target.ClusterID = clusterID
+		target.ClusterName = clusterName
+	}
+}
+
+// snapshotMetadata returns the metadata stored with snapshots uploaded to the target
+func snapshotMetadata(bc *backupConfig) map[string]string {
+	metadata := map[string]string{}
+	if len(bc.ClusterID) != 0 {
+		metadata[clusterIDMetadata] = bc.ClusterID
+	}
+	if len(bc.ClusterName) != 0 {
+		metadata[clusterNameMetadata] = bc.ClusterName
+	}
+	return metadata
+}
+
+// ownerSidecar returns the content of the owner sidecar of snapshots uploaded to the target, or nil if the cluster
+// isn't known
+func ownerSidecar(bc *backupConfig) ([]byte, error) {
+	metadata := snapshotMetadata(bc)
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(metadata)
+}
+
+// readOwnerSidecar adds the cluster metadata in the owner sidecar data to metadata
+func readOwnerSidecar(data []byte, metadata map[string]string) error {
+	var owner map[string]string
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return fmt.Errorf("failed to parse owner: %v", err)
+	}
+	for _, k := range []string{clusterIDMetadata, clusterNameMetadata} {
+		if v, ok := owner[k]; ok {
+			metadata[k] = v
+		}
+	}
+	return nil
+}
+
+// normalizeMetadata lowercases the metadata names, which are canonicalized differently by each storage service
+func normalizeMetadata(metadata map[string]string) map[string]string {
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		normalized[strings.ToLower(k)] = v
+	}
+	return normalized
+}
+
+// foreignReason returns why an object belongs to another cluster, or an empty string if it doesn't. The cluster name
+// takes precedence over the etcd cluster id, as a restore creates a new etcd cluster. Objects without cluster
+// metadata were uploaded by older versions or while the cluster id was unknown, possibly by another cluster sharing
+// the folder, so they are foreign unless the target adopts them.
+func foreignReason(bc *backupConfig, metadata map[string]string) string {
+	name, id := metadata[clusterNameMetadata], metadata[clusterIDMetadata]
+	if len(name) == 0 && len(id) == 0 {
+		if bc.AdoptUnowned {
+			return ""
+		}
+		return unownedReason
+	}
+	if len(bc.ClusterName) != 0 && len(name) != 0 {
+		if name != bc.ClusterName {
+			return fmt.Sprintf("cluster name %s", name)
+		}
+		return ""
+	}
+	if len(bc.ClusterID) != 0 && len(id) != 0 && id != bc.ClusterID {
+		return fmt.Sprintf("etcd cluster id %s", id)
+	}
+	return ""
+}
+
+// withoutForeign removes the snapshots uploaded by other clusters, which are never touched by retention. The owners
+// are checked concurrently.
+func withoutForeign(backend storageBackend, bc *backupConfig, snapshots []*snapshot) []*snapshot {
+	if len(bc.ClusterID) == 0 && len(bc.ClusterName) == 0 {
+		return snapshots
+	}
+	foreign := map[*snapshot]bool{}
+	var unowned []string
+	var mu sync.Mutex
+	forEachSnapshot(snapshots, func(s *snapshot) {
+		info, err := backend.Stat(s.Keys[0])
+		if err != nil {
+			// Keep the snapshot when in doubt
+			log.Errorf("Error detected while checking cluster of [%s], skipping it: %v", s.Keys[0], err)
+			mu.Lock()
+			foreign[s] = true
+			mu.Unlock()
+			return
+		}
+		reason := foreignReason(bc, info.Metadata)
+		if len(reason) == 0 {
+			return
+		}
+		mu.Lock()
+		foreign[s] = true
+		if reason == unownedReason {
+			unowned = append(unowned, s.Name)
+		}
+		mu.Unlock()
+		if reason != unownedReason {
+			log.WithFields(log.Fields{
+				"name":   s.Name,
+				"target": bc.Name,
+				"owner":  reason,
+			}).Warn("Skipping snapshot of another cluster")
+		}
+	})
+	if len(unowned) != 0 {
+		sort.Strings(unowned)
+		log.WithFields(log.Fields{
+			"target":  bc.Name,
+			"unowned": strings.Join(unowned, ", "),
+		}).Warnf("Skipping %d snapshots without cluster metadata, set --adopt-unowned to apply retention to them", len(unowned))
+	}
+	var owned []*snapshot
+	for _, s := range snapshots {
+		if !foreign[s] {
+			owned = append(owned, s)
+		}
+	}
+	return owned
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	rollingSnapshotFilter   = "rolling"
+	recurringSnapshotFilter = "recurring"
+	manualSnapshotFilter    = "manual"
+)
+
+var bulkDeleteFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "bulk",
+		Usage: "delete every snapshot matching --older-than, --type and --prefix instead of --name",
+	},
+	cli.DurationFlag{
+		Name:  "older-than",
+		Usage: "bulk delete snapshots older than this time interval",
+	},
+	cli.StringFlag{
+		Name:  "type",
+		Usage: "bulk delete snapshots of this type: rolling, recurring or manual",
+	},
+	cli.StringFlag{
+		Name:  "prefix",
+		Usage: "bulk delete snapshots with a name starting with this prefix",
+	},
+	cli.BoolFlag{
+		Name:  "confirm",
+		Usage: "confirm the bulk delete, without it the snapshots that would be deleted are only listed",
+	},
+	clusterNameFlag,
+	adoptUnownedFlag,
+	clusterIDFlag,
+}
+
+// snapshotFilter selects the snapshots removed by a bulk delete, every set field must match
+type snapshotFilter struct {
+	OlderThan time.Duration
+	Type      string
+	Prefix    string
+}
+
+func (f snapshotFilter) match(now time.Time, n snapshotName) bool {
+	if f.OlderThan != 0 && !n.Time.Before(now.Add(f.OlderThan*-1)) {
+		return false
+	}
+	switch f.Type {
+	case rollingSnapshotFilter:
+		if !n.Rolling {
+			return false
+		}
+	case recurringSnapshotFilter:
+		if n.Rolling || n.Type != recurringSnapshotType {
+			return false
+		}
+	case manualSnapshotFilter:
+		if n.Type != manualSnapshotType {
+			return false
+		}
+	}
+	return strings.HasPrefix(n.Name, f.Prefix)
+}
+
+// deleteSnapshotKeys removes exactly the compressed and uncompressed variants of name from the backend, together with
+// its pin marker. A pinned snapshot is only removed when forced.
+func deleteSnapshotKeys(backend storageBackend, bc *backupConfig, name string, force bool) error {
+	var keys []string
+	var failed int
+	for _, file := range []string{fmt.Sprintf("%s.%s", name, compressedExtension), name} {
+		key := folderKey(bc, file)
+		if _, err := backend.Stat(key); err != nil {
+			if err == errObjectNotFound {
+				log.WithFields(log.Fields{
+					"name":   key,
+					"target": bc.Name,
+				}).Info("Backup file not found")
+				continue
+			}
+			log.Errorf("Failed to stat [%s] in backup target [%s]: %v", key, bc.Name, err)
+			failed++
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	// Backends without pinningBackend keep the pin in a marker object, which would pin a later snapshot of the same name
+	markers := map[string]bool{}
+	marker := folderKey(bc, fmt.Sprintf("%s.%s", name, pinnedExtension))
+	if _, ok := backend.(pinningBackend); !ok {
+		if _, err := backend.Stat(marker); err == nil {
+			markers[marker] = true
+		} else if err != errObjectNotFound {
+			return fmt.Errorf("failed to stat pin marker [%s] in backup target [%s]: %v", marker, bc.Name, err)
+		}
+	}
+	if len(keys) != 0 {
+		pinned, err := isRemotePinned(backend, &snapshot{Name: name, Keys: keys}, markers)
+		if err != nil {
+			return fmt.Errorf("failed to check pin of snapshot [%s] in backup target [%s]: %v", name, bc.Name, err)
+		}
+		if pinned && !force {
+			return fmt.Errorf("snapshot [%s] is pinned in backup target [%s], unpin it or set --force to delete it", name, bc.Name)
+		}
+		if pinned {
+			log.WithFields(log.Fields{
+				"name":   name,
+				"target": bc.Name,
+			}).Warn("Deleting pinned snapshot")
+		}
+	}
+
+	var removed []string
+	for _, key := range keys {
+		if err := backend.Delete(key); err != nil {
+			log.Errorf("Failed to delete [%s] from backup target [%s]: %v", key, bc.Name, err)
+			failed++
+			continue
+		}
+		log.WithFields(log.Fields{
+			"name":   key,
+			"target": bc.Name,
+		}).Info("Deleted backup file")
+		removed = append(removed, key)
+	}
+	pruneVersions(backend, bc, removed, bc.KeepVersions)
+	if failed != 0 {
+		return fmt.Errorf("failed to delete %d files of snapshot [%s] from backup target [%s]", failed, name, bc.Name)
+	}
+	if markers[marker] {
+		if err := backend.Delete(marker); err != nil {
+			return fmt.Errorf("failed to delete pin marker [%s] from backup target [%s]: %v", marker, bc.Name, err)
+		}
+	}
+	if len(removed) == 0 {
+		log.Warnf("Snapshot [%s] not found in backup target [%s]", name, bc.Name)
+	}
+	return nil
+}
+
+// BulkDeleteAction deletes every snapshot matching the filter locally and, if selected, in a storage target.
+// Pinned snapshots and snapshots of other clusters are skipped. Without confirm, the snapshots are only listed.
+func BulkDeleteAction(c *cli.Context) error {
+	filter := snapshotFilter{
+		OlderThan: c.Duration("older-than"),
+		Type:      c.String("type"),
+		Prefix:    c.String("prefix"),
+	}
+	if filter.OlderThan == 0 && len(filter.Type) == 0 && len(filter.Prefix) == 0 {
+		return fmt.Errorf("bulk delete requires at least one of older-than, type or prefix")
+	}
+	switch filter.Type {
+	case "", rollingSnapshotFilter, recurringSnapshotFilter, manualSnapshotFilter:
+	default:
+		return fmt.Errorf("invalid type [%s], expected rolling, recurring or manual", filter.Type)
+	}
+	confirm := c.Bool("confirm")
+	if !confirm {
+		log.Info("Listing the snapshots that would be deleted, use --confirm to delete them")
+	}
+	now := time.Now()
+
+	var failed int
+	files, err := os.ReadDir(backupBaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read backup directory: %v", err)
+	}
+	local := newSnapshotSet()
+	for _, file := range files {
+		n, err := parseSnapshotName(file.Name())
+		if file.IsDir() || err != nil {
+			continue
+		}
+		// Snapshots without a timestamp in their name are as old as their file
+		if n.Time.IsZero() {
+			fi, err := file.Info()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"name":  file.Name(),
+					"error": err,
+				}).Warn("Couldn't stat backup")
+				continue
+			}
+			n.Time = fi.ModTime()
+		}
+		if filter.match(now, n) {
+			local.add(n, file.Name(), 0)
+		}
+	}
+	queued, err := queuedFiles(uploadQueueFile)
+	if err != nil {
+		return err
+	}
+	unpinned := withoutPinned(backupBaseDir, local.snapshots, func(s *snapshot) (bool, error) {
+		return isLocalPinned(s.Name), nil
+	})
+	for _, s := range withoutQueued(unpinned, queued) {
+		for _, file := range s.Keys {
+			if !confirm {
+				log.WithFields(log.Fields{
+					"location": backupBaseDir,
+					"name":     file,
+				}).Info("Would delete backup file")
+				continue
+			}
+			if err := deleteBackup(file); err != nil {
+				failed++
+			}
+		}
+	}
+
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
+		bc, err := selectedStorageTarget(c)
+		if err != nil {
+			return err
+		}
+		setClusterOwner([]*backupConfig{bc}, c.String("cluster-id"), c.String("cluster-name"))
+		ctx := context.Background()
+		backend, err := newStorageBackend(ctx, bc)
+		if err != nil {
+			return err
+		}
+		defer closeStorageBackend(backend)
+
+		prefix := ""
+		if len(bc.Folder) != 0 {
+			prefix = fmt.Sprintf("%s/", bc.Folder)
+		}
+		remote := newSnapshotSet()
+		markers := map[string]bool{}
+		err = backend.List(prefix, false, func(object objectInfo) error {
+			if strings.HasSuffix(object.Key, fmt.Sprintf(".%s", pinnedExtension)) {
+				markers[object.Key] = true
+				return nil
+			}
+			n, err := parseSnapshotName(strings.TrimPrefix(object.Key, prefix))
+			if err != nil {
+				return nil
+			}
+			if n.Time.IsZero() {
+				n.Time = object.LastModified
+			}
+			if filter.match(now, n) {
+				remote.add(n, object.Key, object.Size)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list backup target [%s]: %v", bc.Name, err)
+		}
+		unpinned := withoutPinned(bc.Name, remote.snapshots, func(s *snapshot) (bool, error) {
+			return isRemotePinned(backend, s, markers)
+		})
+		var removed []string
+		for _, s := range withoutForeign(backend, bc, unpinned) {
+			for _, key := range s.Keys {
+				if !confirm {
+					log.WithFields(log.Fields{
+						"location": bc.Name,
+						"name":     key,
+					}).Info("Would delete backup file")
+					continue
+				}
+				if err := backend.Delete(key); err != nil {
+					log.Errorf("Failed to delete [%s] from backup target [%s]: %v", key, bc.Name, err)
+					failed++
+					continue
+				}
+				log.WithFields(log.Fields{
+					"name":   key,
+					"target": bc.Name,
+				}).Info("Deleted backup file")
+				removed = append(removed, key)
+			}
+		}
+		pruneVersions(backend, bc, removed, bc.KeepVersions)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to delete %d backup files", failed)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDeleteSnapshotKeysPinned refuses to delete a pinned snapshot unless forced, and removes its pin marker with it
+func TestDeleteSnapshotKeysPinned(t *testing.T) {
+	root := t.TempDir()
+	bc := &backupConfig{Name: "nfs", Type: filesystemStorageType, Path: root, Folder: "folder"}
+	backend, err := newFilesystemBackend(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(t.TempDir(), "snapshot.zip")
+	if err := os.WriteFile(local, []byte("snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	name := "2024-03-15T00:00:00Z_etcd"
+	key := folderKey(bc, name+"."+compressedExtension)
+	if err := backend.Put(key, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRemotePinned(backend, folderKey(bc, name), []string{key}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteSnapshotKeys(backend, bc, name, false); err == nil {
+		t.Fatal("deleteSnapshotKeys of a pinned snapshot succeeded")
+	}
+	if _, err := backend.Stat(key); err != nil {
+		t.Fatalf("pinned snapshot was removed: %v", err)
+	}
+
+	if err := deleteSnapshotKeys(backend, bc, name, true); err != nil {
+		t.Fatalf("deleteSnapshotKeys with force: %v", err)
+	}
+	for _, k := range []string{key, folderKey(bc, name+"."+pinnedExtension)} {
+		if _, err := backend.Stat(k); err != errObjectNotFound {
+			t.Errorf("%s was left behind: %v", k, err)
+		}
+	}
+}
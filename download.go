@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	zipLocalHeaderSignature    = 0x04034b50
+	zipDataDescriptorSignature = 0x08074b50
+	// zipDataDescriptorFlag is set when the sizes and CRC-32 follow the data instead of being in the local header
+	zipDataDescriptorFlag = 0x8
+	zip64ExtraID          = 0x0001
+)
+
+// downloadObject downloads object to filePath through a partial file, which is only renamed to filePath once its size
+// and checksum check out. On backends that support ranged reads, an interrupted download is resumed where it stopped,
+// also by a later run if this one was killed, as long as the object is still the version the partial file was started
+// from. The partial file and its validator are removed once they can't be resumed or the retries are exhausted.
+func downloadObject(ctx context.Context, backend storageBackend, object objectInfo, filePath string) error {
+	partialPath := fmt.Sprintf("%s.%s", filePath, partialExtension)
+	rb, resumable := backend.(rangeBackend)
+	validator := objectValidator(object)
+	err := retry(ctx, downloadOperation, defaultS3Retries, func(uint) error {
+		var offset int64
+		if fi, err := os.Stat(partialPath); err == nil {
+			if resumable && len(validator) != 0 && fi.Size() <= object.Size {
+				if data, err := os.ReadFile(validatorPath(partialPath)); err == nil && string(data) == validator {
+					offset = fi.Size()
+				}
+			}
+			if offset == 0 {
+				removePartial(partialPath)
+			}
+		}
+		if offset == 0 {
+			// Written first, so the partial file of an interrupted download always has one
+			if err := os.WriteFile(validatorPath(partialPath), []byte(validator), 0600); err != nil {
+				return err
+			}
+			if err := backend.Get(object.Key, partialPath); err != nil {
+				return err
+			}
+		} else if offset < object.Size {
+			log.Infof("Resuming download of [%s] at byte %d", object.Key, offset)
+			f, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+			err = rb.GetRange(object.Key, offset, f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		fi, err := os.Stat(partialPath)
+		if err != nil {
+			return err
+		}
+		if fi.Size() != object.Size {
+			os.Remove(partialPath)
+			return fmt.Errorf("downloaded [%s] has size %d, expected %d", object.Key, fi.Size(), object.Size)
+		}
+		return verifyDownload(backend, object.Key, partialPath)
+	})
+	if err != nil {
+		removePartial(partialPath)
+		return err
+	}
+	os.Remove(validatorPath(partialPath))
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return err
+	}
+	return os.Chmod(filePath, 0600)
+}
+
+// removePartial removes a partial download and its validator
+func removePartial(partialPath string) {
+	os.Remove(partialPath)
+	os.Remove(validatorPath(partialPath))
+}
+
+// objectValidator returns the ETag of object, or else its modification time as reported by the target, so the
+// clock of this node doesn't matter. It is empty when the target reports neither.
+func objectValidator(object objectInfo) string {
+	if len(object.ETag) != 0 {
+		return object.ETag
+	}
+	if object.LastModified.IsZero() {
+		return ""
+	}
+	return object.LastModified.UTC().Format(time.RFC3339Nano)
+}
+
+// streamDecompress extracts the snapshot at filePath from the archive object while downloading it, so the archive is
+// never stored. The archive is checked against its checksum and the snapshot against its CRC-32 before the snapshot
+// is renamed to filePath.
+func streamDecompress(ctx context.Context, backend storageBackend, object objectInfo, filePath string) error {
+	rb, ok := backend.(rangeBackend)
+	if !ok {
+		return fmt.Errorf("backup target doesn't support streaming downloads")
+	}
+	info, err := backend.Stat(object.Key)
+	if err != nil {
+		return fmt.Errorf("failed to stat [%s]: %w", object.Key, err)
+	}
+	expected, ok := info.Metadata[checksumMetadata]
+	if !ok {
+		log.Warnf("No checksum stored for [%s], skipping verification", object.Key)
+	}
+
+	partialPath := fmt.Sprintf("%s.%s", filePath, partialExtension)
+	defer os.Remove(partialPath)
+	err = retry(ctx, downloadOperation, defaultS3Retries, func(uint) error {
+		pr, pw := io.Pipe()
+		h := sha256.New()
+		done := make(chan error, 1)
+		go func() {
+			err := extractZipStream(io.TeeReader(pr, h), filePath, partialPath)
+			// Stops the download if the archive is rejected early
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		err := rb.GetRange(object.Key, 0, pw)
+		pw.CloseWithError(err)
+		if xerr := <-done; xerr != nil {
+			return xerr
+		}
+		if err != nil {
+			return err
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); len(expected) != 0 && actual != expected {
+			log.WithFields(log.Fields{
+				"key":      object.Key,
+				"expected": expected,
+				"actual":   actual,
+			}).Error("Checksum mismatch, removed the file")
+			return fmt.Errorf("checksum mismatch for [%s]: expected %s, got %s", object.Key, expected, actual)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return err
+	}
+	log.Infof("Decompressed [%s] to [%s] while downloading", object.Key, filePath)
+	return nil
+}
+
+// extractZipStream writes the file called name from the zip archive read from r to dest, reading the archive
+// sequentially through the local file headers. Archives written by compressFiles store the sizes after the data, which
+// is fine as deflate streams end by themselves. The remainder of r is read as well.
+func extractZipStream(r io.Reader, name, dest string) error {
+	br := &countingReader{r: bufio.NewReader(r)}
+	var found bool
+	for {
+		var sig uint32
+		if err := binary.Read(br, binary.LittleEndian, &sig); err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		// The central directory follows the last file
+		if sig != zipLocalHeaderSignature {
+			break
+		}
+		var header struct {
+			Version, Flags, Method, Time, Date uint16
+			CRC32, CompressedSize, Size        uint32
+			NameLen, ExtraLen                  uint16
+		}
+		if err := binary.Read(br, binary.LittleEndian, &header); err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		entryName := make([]byte, header.NameLen)
+		if _, err := io.ReadFull(br, entryName); err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		extra := make([]byte, header.ExtraLen)
+		if _, err := io.ReadFull(br, extra); err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		var w io.Writer = io.Discard
+		var out *os.File
+		if string(entryName) == name && !found {
+			var err error
+			if out, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				return err
+			}
+			w = out
+		}
+		err := extractZipEntry(br, header.Flags, header.Method, header.CRC32, header.CompressedSize, hasZip64Extra(extra), w)
+		if out != nil {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			found = true
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract [%s]: %v", entryName, err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("File [%s] not found in archive", name)
+	}
+	return nil
+}
+
+// hasZip64Extra reports whether the extra fields of a local header include zip64 sizes, which makes the data
+// descriptor hold 8 byte sizes
+func hasZip64Extra(extra []byte) bool {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if id == zip64ExtraID {
+			return true
+		}
+		if len(extra) < 4+size {
+			break
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+func extractZipEntry(br *countingReader, flags, method uint16, crc, compressedSize uint32, zip64 bool, w io.Writer) error {
+	h := crc32.NewIEEE()
+	start := br.n
+	var size int64
+	switch method {
+	case zip.Deflate:
+		fr := flate.NewReader(br)
+		n, err := io.Copy(io.MultiWriter(w, h), fr)
+		fr.Close()
+		if err != nil {
+			return err
+		}
+		size = n
+	case zip.Store:
+		if flags&zipDataDescriptorFlag != 0 {
+			return fmt.Errorf("stored entries of unknown size can't be streamed")
+		}
+		n, err := io.CopyN(io.MultiWriter(w, h), br, int64(compressedSize))
+		if err != nil {
+			return err
+		}
+		size = n
+	default:
+		return fmt.Errorf("unsupported compression method %d", method)
+	}
+	compressed := br.n - start
+
+	if flags&zipDataDescriptorFlag != 0 {
+		// The signature of the data descriptor is optional
+		var sig uint32
+		if err := binary.Read(br, binary.LittleEndian, &sig); err != nil {
+			return err
+		}
+		if sig == zipDataDescriptorSignature {
+			if err := binary.Read(br, binary.LittleEndian, &crc); err != nil {
+				return err
+			}
+		} else {
+			crc = sig
+		}
+		// Writers that stream add a zip64 extra field upfront, archive/zip only uses zip64 sizes when they are needed
+		sizesLen := int64(8)
+		if zip64 || compressed >= math.MaxUint32 || size >= math.MaxUint32 {
+			sizesLen = 16
+		}
+		if _, err := io.CopyN(io.Discard, br, sizesLen); err != nil {
+			return err
+		}
+	}
+	if h.Sum32() != crc {
+		return fmt.Errorf("CRC-32 mismatch")
+	}
+	return nil
+}
+
+// countingReader counts the bytes read. It implements io.ByteReader, so the flate reader doesn't read past the end of
+// a deflate stream.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
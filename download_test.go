@@ -0,0 +1,263 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArchive writes the files to a directory and archives them with compressFiles. It returns the archive and the
+// names of the files in it.
+func testArchive(t *testing.T, contents ...string) ([]byte, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	var names []string
+	for i, content := range contents {
+		name := filepath.Join(dir, strings.Repeat("f", i+1))
+		if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	archive, err := compressFiles(filepath.Join(dir, "snapshot"), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, names
+}
+
+func TestExtractZipStream(t *testing.T) {
+	snapshot := strings.Repeat("etcd snapshot ", 10000)
+	archive, names := testArchive(t, snapshot, "statefile")
+	dest := filepath.Join(t.TempDir(), "snapshot")
+
+	for _, name := range names {
+		if err := extractZipStream(bytes.NewReader(archive), name, dest); err != nil {
+			t.Fatalf("extractZipStream of %s: %v", name, err)
+		}
+	}
+	if err := extractZipStream(bytes.NewReader(archive), names[0], dest); err != nil {
+		t.Fatalf("extractZipStream: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != snapshot {
+		t.Errorf("extracted %d bytes, expected the %d bytes of the snapshot", len(data), len(snapshot))
+	}
+
+	if err := extractZipStream(bytes.NewReader(archive), "missing", dest); err == nil {
+		t.Error("extractZipStream of a missing file succeeded")
+	}
+
+	// archive/zip writes the CRC-32 to the data descriptor after the data
+	corrupted := bytes.Clone(archive)
+	i := bytes.Index(corrupted, []byte("PK\x07\x08"))
+	if i < 0 {
+		t.Fatal("archive has no data descriptor")
+	}
+	corrupted[i+4] ^= 0xff
+	if err := extractZipStream(bytes.NewReader(corrupted), names[0], dest); err == nil || !strings.Contains(err.Error(), "CRC-32") {
+		t.Errorf("extractZipStream of an archive with a corrupted CRC-32 returned %v", err)
+	}
+}
+
+func TestExtractZipStreamStored(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "snapshot")
+
+	// Stored entries with a data descriptor have no size upfront and no end marker
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "snapshot", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "snapshot")
+	zw.Close()
+	if err := extractZipStream(&buf, "snapshot", dest); err == nil || !strings.Contains(err.Error(), "can't be streamed") {
+		t.Errorf("extractZipStream of a stored entry with a data descriptor returned %v", err)
+	}
+
+	// With the size in the local header they can be read
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	w, err = zw.CreateRaw(&zip.FileHeader{
+		Name:               "snapshot",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte("snapshot")),
+		CompressedSize64:   8,
+		UncompressedSize64: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "snapshot")
+	zw.Close()
+	if err := extractZipStream(&buf, "snapshot", dest); err != nil {
+		t.Fatalf("extractZipStream of a stored entry: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "snapshot" {
+		t.Errorf("extracted %q, expected %q", data, "snapshot")
+	}
+}
+
+// TestExtractZipStreamZip64 reads an archive like streaming writers produce, with a zip64 extra field in the local
+// header and 8 byte sizes in the data descriptor of a small entry
+func TestExtractZipStreamZip64(t *testing.T) {
+	content := []byte("snapshot")
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	fw.Close()
+
+	var archive bytes.Buffer
+	le := func(v interface{}) {
+		binary.Write(&archive, binary.LittleEndian, v)
+	}
+	for _, name := range []string{"first", "snapshot"} {
+		le(uint32(zipLocalHeaderSignature))
+		// Version, flags, method, time, date, CRC-32 and sizes, which follow the data
+		le([]uint16{45, zipDataDescriptorFlag, zip.Deflate, 0, 0})
+		le([]uint32{0, 0xffffffff, 0xffffffff})
+		le([]uint16{uint16(len(name)), 20})
+		archive.WriteString(name)
+		le([]uint16{zip64ExtraID, 16})
+		le([]uint64{0, 0})
+		archive.Write(compressed.Bytes())
+		le(uint32(zipDataDescriptorSignature))
+		le(crc32.ChecksumIEEE(content))
+		le([]uint64{uint64(compressed.Len()), uint64(len(content))})
+	}
+	// Start of the central directory, which isn't read
+	le(uint32(0x02014b50))
+
+	dest := filepath.Join(t.TempDir(), "snapshot")
+	if err := extractZipStream(&archive, "snapshot", dest); err != nil {
+		t.Fatalf("extractZipStream: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, content) {
+		t.Errorf("extracted %q, expected %q", data, content)
+	}
+}
+
+// recordingBackend records the offsets a download reads from, 0 for Get
+type recordingBackend struct {
+	*filesystemBackend
+	offsets []int64
+}
+
+func (r *recordingBackend) Get(key, filePath string) error {
+	r.offsets = append(r.offsets, 0)
+	return r.filesystemBackend.Get(key, filePath)
+}
+
+func (r *recordingBackend) GetRange(key string, offset int64, w io.Writer) error {
+	r.offsets = append(r.offsets, offset)
+	return r.filesystemBackend.GetRange(key, offset, w)
+}
+
+// newDownloadTest uploads an archive to a filesystem target and returns the target, the object and the path to
+// download it to
+func newDownloadTest(t *testing.T) (*recordingBackend, objectInfo, []byte, string) {
+	t.Helper()
+	archive, _ := testArchive(t, strings.Repeat("etcd snapshot ", 10000))
+	local := filepath.Join(t.TempDir(), "snapshot.zip")
+	if err := os.WriteFile(local, archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := newFilesystemBackend(&backupConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "2024-01-01T00:00:00Z_etcd.zip"
+	if err := fs.Put(key, local); err != nil {
+		t.Fatal(err)
+	}
+	object, err := fs.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &recordingBackend{filesystemBackend: fs}, object, archive, filepath.Join(t.TempDir(), key)
+}
+
+func TestDownloadObjectResume(t *testing.T) {
+	backend, object, archive, filePath := newDownloadTest(t)
+	partialPath := filePath + "." + partialExtension
+	half := int64(len(archive) / 2)
+	if err := os.WriteFile(partialPath, archive[:half], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(validatorPath(partialPath), []byte(objectValidator(object)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadObject(context.Background(), backend, object, filePath); err != nil {
+		t.Fatalf("downloadObject: %v", err)
+	}
+	if len(backend.offsets) != 1 || backend.offsets[0] != half {
+		t.Errorf("download read from offsets %v, expected [%d]", backend.offsets, half)
+	}
+	if data, _ := os.ReadFile(filePath); !bytes.Equal(data, archive) {
+		t.Error("resumed download doesn't match the archive")
+	}
+	for _, p := range []string{partialPath, validatorPath(partialPath)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", p, err)
+		}
+	}
+}
+
+// TestDownloadObjectChanged starts over when the object changed since the partial file was started
+func TestDownloadObjectChanged(t *testing.T) {
+	backend, object, archive, filePath := newDownloadTest(t)
+	object.ETag = `"new"`
+	partialPath := filePath + "." + partialExtension
+	if err := os.WriteFile(partialPath, []byte("from the old object"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(validatorPath(partialPath), []byte(`"old"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadObject(context.Background(), backend, object, filePath); err != nil {
+		t.Fatalf("downloadObject: %v", err)
+	}
+	if len(backend.offsets) != 1 || backend.offsets[0] != 0 {
+		t.Errorf("download read from offsets %v, expected [0]", backend.offsets)
+	}
+	if data, _ := os.ReadFile(filePath); !bytes.Equal(data, archive) {
+		t.Error("download doesn't match the archive")
+	}
+}
+
+// TestDownloadObjectFailed leaves neither the partial file nor its validator behind once the retries are exhausted
+func TestDownloadObjectFailed(t *testing.T) {
+	defer func(b retryBackoffConfig) { retryBackoff = b }(retryBackoff)
+	retryBackoff = retryBackoffConfig{Initial: time.Millisecond, Max: time.Millisecond}
+
+	backend, object, _, filePath := newDownloadTest(t)
+	// The download never has the expected size
+	object.Size++
+	if err := downloadObject(context.Background(), backend, object, filePath); err == nil {
+		t.Fatal("downloadObject of an object with the wrong size succeeded")
+	}
+	partialPath := filePath + "." + partialExtension
+	for _, p := range []string{filePath, partialPath, validatorPath(partialPath)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", p, err)
+		}
+	}
+}
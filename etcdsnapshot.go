@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// etcdClientTLSConfig authenticates with the client certificate and verifies the server certificate of etcd against
+// the CA, like etcdctl does. The etcd client checks the host of the endpoint against the certificate.
+func etcdClientTLSConfig(etcdCACert, etcdCert, etcdKey string) (*tls.Config, error) {
+	caCertPem, err := os.ReadFile(etcdCACert)
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caCertPem) {
+		return nil, fmt.Errorf("no certificates found in etcd CA [%s]", etcdCACert)
+	}
+	x509Pair, err := tls.LoadX509KeyPair(etcdCert, etcdKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{x509Pair},
+		RootCAs:      certPool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// etcdSnapshot streams a snapshot of the etcd member at endpoint to w and returns its size. The snapshot ends with
+// the hash of the database, which etcdctl snapshot restore checks.
+func etcdSnapshot(ctx context.Context, etcdCACert, etcdCert, etcdKey, endpoint string, w io.Writer) (int64, error) {
+	if strings.Contains(endpoint, ",") {
+		return 0, permanent(fmt.Errorf("snapshots must be streamed from a single endpoint, got [%s]", endpoint))
+	}
+	tlsConfig, err := etcdClientTLSConfig(etcdCACert, etcdCert, etcdKey)
+	if err != nil {
+		return 0, permanent(err)
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		TLS:         tlsConfig,
+		DialTimeout: timeouts.Etcd,
+		Context:     ctx,
+		// Errors are returned and logged by the caller
+		Logger: zap.NewNop(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	rc, err := client.Snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(w, rc)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filesystemBackend stores snapshots in a directory, usually an NFS or CIFS mount. Files can't carry metadata, so the
+// cluster owning a snapshot is kept in a hidden sidecar next to it.
+type filesystemBackend struct {
+	root string
+	bc   *backupConfig
+}
+
+func newFilesystemBackend(bc *backupConfig) (*filesystemBackend, error) {
+	root := bc.Path
+	if len(root) == 0 {
+		return nil, fmt.Errorf("path is required for a filesystem storage target")
+	}
+	// Don't create the root, if it is missing the mount most likely is too
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check storage path %s: %v", root, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("storage path %s is not a directory", root)
+	}
+	return &filesystemBackend{root: root, bc: bc}, nil
+}
+
+func (f *filesystemBackend) path(key string) string {
+	return filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// Put copies the file to a temporary name next to the destination and renames it, so a partially written
+// snapshot is never listed. The checksum sidecar is written once the snapshot is in place.
+func (f *filesystemBackend) Put(key, filePath string) error {
+	sum, err := snapshotChecksum(filePath)
+	if err != nil {
+		return permanent(fmt.Errorf("failed to compute checksum of [%s]: %v", filePath, err))
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := f.PutStream(key, src); err != nil {
+		return err
+	}
+	return f.SetChecksum(key, sum)
+}
+
+// PutStream writes the owner sidecar before the snapshot, so retention never sees the snapshot without its owner. The
+// checksum sidecar of a replaced snapshot is removed first, as it doesn't match anymore.
+func (f *filesystemBackend) PutStream(key string, src io.Reader) error {
+	owner, err := ownerSidecar(f.bc)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := f.writeFile(sidecarKey(key, ownerExtension), bytes.NewReader(owner)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(f.path(sidecarKey(key, checksumExtension))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.writeFile(key, src); err != nil {
+		// Don't leave the sidecar behind for a snapshot that never existed
+		if _, serr := os.Stat(f.path(key)); os.IsNotExist(serr) {
+			os.Remove(f.path(sidecarKey(key, ownerExtension)))
+		}
+		return err
+	}
+	return nil
+}
+
+// SetChecksum writes the checksum sidecar of key
+func (f *filesystemBackend) SetChecksum(key, sum string) error {
+	return f.writeFile(sidecarKey(key, checksumExtension), bytes.NewReader(checksumLine(sum, path.Base(key))))
+}
+
+// writeFile writes src to a temporary name next to key and renames it
+func (f *filesystemBackend) writeFile(key string, src io.Reader) error {
+	dest := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (f *filesystemBackend) Get(key, filePath string) error {
+	src, err := os.Open(f.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errObjectNotFound
+		}
+		return err
+	}
+	defer src.Close()
+
+	localFile, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Failed to create local file [%s]: %w", filePath, err)
+	}
+	defer localFile.Close()
+
+	if _, err = io.Copy(localFile, src); err != nil {
+		return fmt.Errorf("Failed to copy file to local file [%s]: %w", filePath, err)
+	}
+	return nil
+}
+
+func (f *filesystemBackend) GetRange(key string, offset int64, w io.Writer) error {
+	src, err := os.Open(f.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errObjectNotFound
+		}
+		return err
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+func (f *filesystemBackend) List(prefix string, recursive bool, fn func(objectInfo) error) error {
+	// Only walk the directory the prefix points into, the remainder of the prefix is matched on the names
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	start := f.path(dir)
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if p != start && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Skip uploads in progress
+		if strings.HasPrefix(d.Name(), ".") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(objectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+	return err
+}
+
+// Delete removes the snapshot before its sidecars, so it is never left behind without its owner
+func (f *filesystemBackend) Delete(key string) error {
+	if err := os.Remove(f.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, extension := range sidecarExtensions {
+		if err := os.Remove(f.path(sidecarKey(key, extension))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *filesystemBackend) Stat(key string) (objectInfo, error) {
+	info, err := os.Stat(f.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return objectInfo{}, errObjectNotFound
+		}
+		return objectInfo{}, err
+	}
+	metadata := map[string]string{}
+	data, err := os.ReadFile(f.path(sidecarKey(key, ownerExtension)))
+	if err == nil {
+		err = readOwnerSidecar(data, metadata)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return objectInfo{}, err
+	}
+	if data, err := os.ReadFile(f.path(sidecarKey(key, checksumExtension))); err == nil {
+		if sum := parseChecksumLine(data); len(sum) != 0 {
+			metadata[checksumMetadata] = sum
+		}
+	} else if !os.IsNotExist(err) {
+		return objectInfo{}, err
+	}
+	return objectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime(), Metadata: metadata}, nil
+}
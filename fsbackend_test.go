@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesystemBackend(t *testing.T) {
+	root := t.TempDir()
+	bc := &backupConfig{Type: filesystemStorageType, Path: root, ClusterID: "1a2b"}
+	backend, err := newFilesystemBackend(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageBackend(t, backend, bc)
+
+	// Uploads in progress and sidecars are hidden files, which are never listed
+	if err := os.WriteFile(filepath.Join(root, "folder", ".2024-01-05T00:00:00Z_etcd.zip.123456"), []byte("snap"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	err = backend.List("folder/", true, func(o objectInfo) error {
+		listed = append(listed, o.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	expected := []string{"folder/2024-01-03T00:00:00Z_etcd.zip", "folder/sub/2024-01-02T00:00:00Z_etcd.zip"}
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Errorf("List returned %v, expected %v", listed, expected)
+	}
+
+	if _, err := newFilesystemBackend(&backupConfig{Path: filepath.Join(root, "missing")}); err == nil {
+		t.Error("newFilesystemBackend with a missing path succeeded")
+	}
+}
+
+// TestFilesystemRetention checks that retention removes the expired snapshots of the cluster from a filesystem
+// target, which keeps the owner in a sidecar, and leaves the snapshots of other clusters and unowned ones alone
+func TestFilesystemRetention(t *testing.T) {
+	root := t.TempDir()
+	local := filepath.Join(t.TempDir(), "snapshot.zip")
+	if err := os.WriteFile(local, []byte("snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc := &backupConfig{
+		Name:      "nfs",
+		Type:      filesystemStorageType,
+		Path:      root,
+		Folder:    "folder",
+		ClusterID: "1a2b",
+		Retention: retentionPolicy{Period: 24 * time.Hour},
+	}
+	other := *bc
+	other.ClusterID = "3c4d"
+
+	put := func(bc *backupConfig, name string) {
+		t.Helper()
+		backend, err := newFilesystemBackend(bc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Put(folderKey(bc, name), local); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put(bc, "2024-03-10T00:00:00Z_etcd.zip")
+	put(bc, "2024-03-15T00:00:00Z_etcd.zip")
+	put(&other, "2024-03-11T00:00:00Z_etcd.zip")
+	// Snapshots stored by older versions have no owner sidecar
+	legacy := filepath.Join(root, "folder", "2024-03-12T00:00:00Z_etcd.zip")
+	if err := os.WriteFile(legacy, []byte("snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots without an owner could belong to another cluster and are only removed once adopted
+	for _, adopt := range []bool{false, true} {
+		bc.AdoptUnowned = adopt
+		DeleteS3Backups(context.Background(), retentionTestNow, bc.Retention, bc)
+
+		for name, exists := range map[string]bool{
+			"2024-03-10T00:00:00Z_etcd.zip":        false,
+			".2024-03-10T00:00:00Z_etcd.zip.owner": false,
+			"2024-03-11T00:00:00Z_etcd.zip":        true,
+			"2024-03-12T00:00:00Z_etcd.zip":        !adopt,
+			"2024-03-15T00:00:00Z_etcd.zip":        true,
+			".2024-03-15T00:00:00Z_etcd.zip.owner": true,
+		} {
+			_, err := os.Stat(filepath.Join(root, "folder", name))
+			if exists && err != nil {
+				t.Errorf("%s was removed with adopt-unowned %t: %v", name, adopt, err)
+			}
+			if !exists && !os.IsNotExist(err) {
+				t.Errorf("%s was not removed with adopt-unowned %t: %v", name, adopt, err)
+			}
+		}
+	}
+}
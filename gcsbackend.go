@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	gcsStorageType = "gcs"
+	// gcsListPageSize is the most objects a listing request returns
+	gcsListPageSize = 1000
+)
+
+// gcsBackend stores snapshots in a Google Cloud Storage bucket using the native JSON API
+type gcsBackend struct {
+	ctx          context.Context
+	client       *storage.Client
+	bucket       *storage.BucketHandle
+	storageClass string
+	versioned    bool
+	metadata     map[string]string
+}
+
+// newGCSBackend authenticates with the service account JSON if set, and otherwise with the application default
+// credentials, which includes workload identity. The STORAGE_EMULATOR_HOST environment variable is honoured to
+// point the client to a local fake GCS server.
+func newGCSBackend(ctx context.Context, bc *backupConfig) (*gcsBackend, error) {
+	log.WithFields(log.Fields{
+		"endpoint": bc.Endpoint,
+		"bucket":   bc.BucketName,
+		"folder":   bc.Folder,
+	}).Info("invoking set gcs service client")
+
+	var opts []option.ClientOption
+	if len(bc.Endpoint) != 0 {
+		opts = append(opts, option.WithEndpoint(bc.Endpoint))
+	}
+	if len(bc.CredentialsJSON) != 0 {
+		creds, err := readFileOrBase64(bc.CredentialsJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gcs credentials: %v", err)
+		}
+		opts = append(opts, option.WithCredentialsJSON(creds))
+	} else {
+		log.Info("invoking set gcs service client use application default credentials")
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %v", err)
+	}
+	bucket := client.Bucket(bc.BucketName)
+	var attrs *storage.BucketAttrs
+	err = withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		attrs, err = bucket.Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		client.Close()
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			return nil, fmt.Errorf("bucket %s is not found", bc.BucketName)
+		}
+		return nil, fmt.Errorf("failed to check gcs bucket:%s, err:%v", bc.BucketName, err)
+	}
+	return &gcsBackend{
+		ctx:          ctx,
+		client:       client,
+		bucket:       bucket,
+		storageClass: bc.StorageClass,
+		versioned:    attrs.VersioningEnabled,
+		metadata:     snapshotMetadata(bc),
+	}, nil
+}
+
+func (g *gcsBackend) Put(key, filePath string) error {
+	metadata, err := uploadMetadata(g.metadata, filePath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// GCS rejects the upload if the object doesn't match the CRC32C
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(crc, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return g.put(key, file, metadata, func(w *storage.Writer) {
+		w.CRC32C = crc.Sum32()
+		w.SendCRC32C = true
+	})
+}
+
+func (g *gcsBackend) PutStream(key string, r io.Reader) error {
+	return g.put(key, r, g.metadata, nil)
+}
+
+func (g *gcsBackend) put(key string, r io.Reader, metadata map[string]string, setup func(w *storage.Writer)) error {
+	return withTimeout(g.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		w := g.bucket.Object(key).NewWriter(ctx)
+		w.ContentType = contentType
+		w.StorageClass = g.storageClass
+		w.Metadata = metadata
+		if setup != nil {
+			setup(w)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			// Closing the writer would commit the truncated object, canceling the context aborts the upload
+			cancel()
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+func (g *gcsBackend) SetChecksum(key, sum string) error {
+	// The update replaces all custom metadata
+	metadata := map[string]string{checksumMetadata: sum}
+	for k, v := range g.metadata {
+		metadata[k] = v
+	}
+	return withTimeout(g.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		_, err := g.bucket.Object(key).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+		return err
+	})
+}
+
+func (g *gcsBackend) Get(key, filePath string) error {
+	return withTimeout(g.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		r, err := g.bucket.Object(key).NewReader(ctx)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return errObjectNotFound
+			}
+			return err
+		}
+		defer r.Close()
+
+		localFile, err := os.Create(filePath)
+		if err != nil {
+			return fmt.Errorf("Failed to create local file [%s]: %w", filePath, err)
+		}
+		defer localFile.Close()
+
+		if _, err = io.Copy(localFile, r); err != nil {
+			return fmt.Errorf("Failed to copy retrieved object to local file [%s]: %w", filePath, err)
+		}
+		return nil
+	})
+}
+
+func (g *gcsBackend) GetRange(key string, offset int64, w io.Writer) error {
+	return withTimeout(g.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		r, err := g.bucket.Object(key).NewRangeReader(ctx, offset, -1)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return errObjectNotFound
+			}
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
+
+func (g *gcsBackend) List(prefix string, recursive bool, fn func(objectInfo) error) error {
+	query := &storage.Query{Prefix: prefix}
+	if !recursive {
+		query.Delimiter = "/"
+	}
+	var token string
+	for {
+		var page []*storage.ObjectAttrs
+		// An iterator is bound to the context it was created with, so each page gets its own, resuming at token
+		err := withTimeout(g.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			var err error
+			token, err = iterator.NewPager(g.bucket.Objects(ctx, query), gcsListPageSize, token).NextPage(&page)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, attrs := range page {
+			// Sub folders are returned as prefixes when using a delimiter
+			if len(attrs.Prefix) != 0 {
+				continue
+			}
+			if err := fn(objectInfo{Key: attrs.Name, Size: attrs.Size, LastModified: attrs.Updated, ETag: attrs.Etag}); err != nil {
+				return err
+			}
+		}
+		if len(token) == 0 {
+			return nil
+		}
+	}
+}
+
+func (g *gcsBackend) Delete(key string) error {
+	err := withTimeout(g.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		return g.bucket.Object(key).Delete(ctx)
+	})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (g *gcsBackend) Stat(key string) (objectInfo, error) {
+	var attrs *storage.ObjectAttrs
+	err := withTimeout(g.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		attrs, err = g.bucket.Object(key).Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return objectInfo{}, errObjectNotFound
+		}
+		return objectInfo{}, err
+	}
+	return objectInfo{Key: attrs.Name, Size: attrs.Size, LastModified: attrs.Updated, ETag: attrs.Etag, Metadata: normalizeMetadata(attrs.Metadata)}, nil
+}
+
+func (g *gcsBackend) VerifiesUploads() bool {
+	return true
+}
+
+func (g *gcsBackend) Versioned() bool {
+	return g.versioned
+}
+
+func (g *gcsBackend) Close() error {
+	return g.client.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+// TestGCSBackend runs against a fake GCS server, with STORAGE_EMULATOR_HOST pointing to it. With fake-gcs-server, run
+// it with -scheme http -public-host set to the same host and port.
+func TestGCSBackend(t *testing.T) {
+	if len(os.Getenv("STORAGE_EMULATOR_HOST")) == 0 {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bucket := "rke-tools-test"
+	if err := client.Bucket(bucket).Create(ctx, "test", nil); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	t.Cleanup(func() {
+		// Objects left behind by a failed test would fail the next run
+		deleteGCSBucket(ctx, client.Bucket(bucket))
+	})
+
+	bc := &backupConfig{Type: gcsStorageType, BucketName: bucket, ClusterID: "1a2b3c"}
+	backend, err := newGCSBackend(ctx, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	testStorageBackend(t, backend, bc)
+
+	if _, err := newGCSBackend(ctx, &backupConfig{Type: gcsStorageType, BucketName: "missing"}); err == nil {
+		t.Error("creating a backend for a missing bucket succeeded")
+	}
+}
+
+func deleteGCSBucket(ctx context.Context, bucket *storage.BucketHandle) {
+	it := bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err != nil {
+			break
+		}
+		bucket.Object(attrs.Name).Delete(ctx)
+	}
+	bucket.Delete(ctx)
+}
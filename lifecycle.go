@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	lifecycleRuleIDPrefix = "rke-etcd-backup"
+	noSuchLifecycleConfig = "NoSuchLifecycleConfiguration"
+	lifecycleDay          = 24 * time.Hour
+)
+
+var lifecycleFlags = append(append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.DurationFlag{
+		Name:  "retention",
+		Usage: "Expire snapshots in the s3 folder after this time interval, rounded up to whole days. --s3-retention takes precedence",
+		Value: 24 * time.Hour,
+	},
+	cli.DurationFlag{
+		Name:  "transition-after",
+		Usage: "Move snapshots to --transition-storage-class after this time interval, rounded up to whole days",
+	},
+	cli.StringFlag{
+		Name:  "transition-storage-class",
+		Usage: "Storage class to move snapshots to after --transition-after",
+	},
+	clusterNameFlag,
+	adoptUnownedFlag,
+	clusterIDFlag,
+}, retentionFlags...), s3Flags...)
+
+func LifecycleAction(c *cli.Context) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	bc := newBackupConfig(c)
+	if len(bc.Folder) == 0 {
+		return fmt.Errorf("s3-folder is required, lifecycle rules are not applied to the whole bucket")
+	}
+	bc.Name = defaultTargetName
+	setClusterOwner([]*backupConfig{bc}, c.String("cluster-id"), c.String("cluster-name"))
+	retention, err := lifecycleRetention(c)
+	if err != nil {
+		return err
+	}
+	rule, err := snapshotLifecycleRule(bc.Folder, retention, c.Duration("transition-after"), c.String("transition-storage-class"))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := minioClientFromConfig(ctx, bc)
+	if err != nil {
+		return err
+	}
+	backend := &s3Backend{ctx: ctx, client: client, bc: bc}
+	conflicts, err := lifecycleConflicts(backend, bc)
+	if err != nil {
+		return fmt.Errorf("failed to check the snapshots in s3-folder %s: %v", bc.Folder, err)
+	}
+	if len(conflicts) != 0 {
+		for _, conflict := range conflicts {
+			log.Warn(conflict)
+		}
+		return fmt.Errorf("refusing to install a lifecycle rule, %d objects in s3-folder %s would be expired by it but not by the retention", len(conflicts), bc.Folder)
+	}
+	var config *lifecycle.Configuration
+	err = withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		config, err = client.GetBucketLifecycle(ctx, bc.BucketName)
+		return err
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != noSuchLifecycleConfig {
+			return fmt.Errorf("failed to get lifecycle configuration for bucket %s: %v", bc.BucketName, err)
+		}
+		config = lifecycle.NewConfiguration()
+	}
+
+	// Replace our own rule and keep every other rule on the bucket as-is
+	rules := []lifecycle.Rule{rule}
+	for _, r := range config.Rules {
+		if r.ID != rule.ID {
+			rules = append(rules, r)
+		}
+	}
+	config.Rules = rules
+
+	err = withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		return client.SetBucketLifecycle(ctx, bc.BucketName, config)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle configuration for bucket %s: %v", bc.BucketName, err)
+	}
+	log.WithFields(log.Fields{
+		"s3-bucketName":   bc.BucketName,
+		"rule":            rule.ID,
+		"prefix":          rule.RuleFilter.Prefix,
+		"expiration-days": int(rule.Expiration.Days),
+		"transition-days": int(rule.Transition.Days),
+		"storage-class":   rule.Transition.StorageClass,
+	}).Info("Installed s3 lifecycle rule")
+	return nil
+}
+
+// lifecycleRetention returns the retention period of the s3 target. A lifecycle rule can only expire objects by age,
+// so the policy must be time based and can't keep the newest snapshots.
+func lifecycleRetention(c *cli.Context) (time.Duration, error) {
+	policy, err := newRetentionPolicy(c, c.Duration("retention"))
+	if err != nil {
+		return 0, err
+	}
+	retention, err := parseRetentionPolicy(c.String("s3-retention"), policy)
+	if err != nil {
+		return 0, fmt.Errorf("invalid s3-retention: %v", err)
+	}
+	if retention.MaxBytes, err = parseByteSize(c.String("s3-max-bytes")); err != nil {
+		return 0, fmt.Errorf("invalid s3-max-bytes: %v", err)
+	}
+	if retention.tiered() || retention.MaxBytes != 0 {
+		return 0, fmt.Errorf("lifecycle rules can only expire snapshots by age, the retention %s with a size budget of %d bytes can't be expressed as one", retention, retention.MaxBytes)
+	}
+	// The default min-keep only guards the retention of save and prune, an explicit one can't be honored
+	if retention.MinKeep != 0 {
+		if c.IsSet("min-keep") {
+			return 0, fmt.Errorf("lifecycle rules also expire the newest snapshots, min-keep %d can't be honored", retention.MinKeep)
+		}
+		log.Warnf("The lifecycle rule expires every snapshot older than %d days, including the newest %d snapshots kept by min-keep", lifecycleDays(retention.Period), retention.MinKeep)
+	}
+	return retention.Period, nil
+}
+
+// ExpiryRule returns the id of an enabled lifecycle rule of the bucket that expires key, or an empty string if there
+// is none
+func (s *s3Backend) ExpiryRule(key string) (string, error) {
+	var config *lifecycle.Configuration
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		config, err = s.client.GetBucketLifecycle(ctx, s.bc.BucketName)
+		return err
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == noSuchLifecycleConfig {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, rule := range config.Rules {
+		// Rules that only remove delete markers don't expire snapshots
+		if rule.Status != "Enabled" || (rule.Expiration.IsDaysNull() && rule.Expiration.IsDateNull()) {
+			continue
+		}
+		prefix := rule.RuleFilter.Prefix
+		if len(prefix) == 0 {
+			prefix = rule.RuleFilter.And.Prefix
+		}
+		if len(prefix) == 0 {
+			prefix = rule.Prefix
+		}
+		if strings.HasPrefix(key, prefix) {
+			return rule.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// lifecycleConflicts returns the objects in the folder of bc that the retention leaves alone: anything but recurring
+// snapshots, and pinned snapshots or snapshots of other clusters. A lifecycle rule would expire them all the same.
+func lifecycleConflicts(backend storageBackend, bc *backupConfig) ([]string, error) {
+	prefix := fmt.Sprintf("%s/", bc.Folder)
+	var conflicts []string
+	snapshots := newSnapshotSet()
+	err := backend.List(prefix, true, func(object objectInfo) error {
+		if strings.HasSuffix(object.Key, fmt.Sprintf(".%s", pinnedExtension)) {
+			conflicts = append(conflicts, fmt.Sprintf("[%s] pins a snapshot", object.Key))
+			return nil
+		}
+		n, err := parseSnapshotName(strings.TrimPrefix(object.Key, prefix))
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("[%s] is not a snapshot", object.Key))
+			return nil
+		}
+		if !n.recurring() {
+			conflicts = append(conflicts, fmt.Sprintf("[%s] is a manual snapshot", object.Key))
+			return nil
+		}
+		snapshots.add(n, object.Key, object.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Checking pins and owners of %d snapshots", len(snapshots.snapshots))
+	unpinned := withoutPinned(bc.Name, snapshots.snapshots, func(s *snapshot) (bool, error) {
+		return isRemotePinned(backend, s, map[string]bool{})
+	})
+	owned := map[*snapshot]bool{}
+	for _, s := range withoutForeign(backend, bc, unpinned) {
+		owned[s] = true
+	}
+	for _, s := range snapshots.snapshots {
+		if !owned[s] {
+			conflicts = append(conflicts, fmt.Sprintf("[%s] is pinned, belongs to another cluster or couldn't be checked", s.Name))
+		}
+	}
+	return conflicts, nil
+}
+
+// snapshotLifecycleRule builds the lifecycle rule for the snapshots stored in folder. S3 only counts in whole
+// days, so periods are rounded up to make sure the bucket never expires a snapshot before DeleteS3Backups would.
+func snapshotLifecycleRule(folder string, retention, transitionAfter time.Duration, transitionStorageClass string) (lifecycle.Rule, error) {
+	if retention <= 0 {
+		return lifecycle.Rule{}, fmt.Errorf("retention must be set")
+	}
+	rule := lifecycle.Rule{
+		ID:     fmt.Sprintf("%s-%s", lifecycleRuleIDPrefix, folder),
+		Status: "Enabled",
+		RuleFilter: lifecycle.Filter{
+			Prefix: fmt.Sprintf("%s/", folder),
+		},
+		Expiration: lifecycle.Expiration{
+			Days: lifecycle.ExpirationDays(lifecycleDays(retention)),
+		},
+	}
+	if transitionAfter > 0 || len(transitionStorageClass) != 0 {
+		if transitionAfter <= 0 || len(transitionStorageClass) == 0 {
+			return lifecycle.Rule{}, fmt.Errorf("transition-after and transition-storage-class must be set together")
+		}
+		if lifecycleDays(transitionAfter) >= lifecycleDays(retention) {
+			return lifecycle.Rule{}, fmt.Errorf("transition-after [%s] must be shorter than retention [%s]", transitionAfter, retention)
+		}
+		rule.Transition = lifecycle.Transition{
+			Days:         lifecycle.ExpirationDays(lifecycleDays(transitionAfter)),
+			StorageClass: transitionStorageClass,
+		}
+	}
+	return rule, nil
+}
+
+func lifecycleDays(d time.Duration) int {
+	days := int((d + lifecycleDay - 1) / lifecycleDay)
+	if days < 1 {
+		return 1
+	}
+	return days
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var listFlags = append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.BoolFlag{
+		Name:   "s3-backup",
+		Usage:  "Also list the snapshots in the s3 target",
+		EnvVar: "S3_BACKUP",
+	},
+	cli.BoolFlag{
+		Name:  "versions",
+		Usage: "On versioned buckets, also list the versions of every snapshot file",
+	},
+	storageTargetsFlag,
+	storageTargetFlag,
+}, s3Flags...)
+
+// ListBackupAction prints the snapshots in /backup and, if selected, in a storage target
+func ListBackupAction(c *cli.Context) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LOCATION\tNAME\tSIZE\tCREATED\tPINNED")
+
+	files, err := os.ReadDir(backupBaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read backup directory: %v", err)
+	}
+	for _, file := range files {
+		n, err := parseSnapshotName(file.Name())
+		if file.IsDir() || err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if n.Time.IsZero() {
+			n.Time = info.ModTime()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\n", backupBaseDir, file.Name(), info.Size(), n.Time.Format(time.RFC3339),
+			isLocalPinned(n.Name))
+	}
+
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
+		bc, err := selectedStorageTarget(c)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		backend, err := newStorageBackend(ctx, bc)
+		if err != nil {
+			return err
+		}
+		defer closeStorageBackend(backend)
+
+		prefix := ""
+		if len(bc.Folder) != 0 {
+			prefix = fmt.Sprintf("%s/", bc.Folder)
+		}
+		var objects []objectInfo
+		var names []snapshotName
+		markers := map[string]bool{}
+		err = backend.List(prefix, false, func(object objectInfo) error {
+			if strings.HasSuffix(object.Key, fmt.Sprintf(".%s", pinnedExtension)) {
+				markers[object.Key] = true
+				return nil
+			}
+			n, err := parseSnapshotName(strings.TrimPrefix(object.Key, prefix))
+			if err != nil {
+				return nil
+			}
+			if n.Time.IsZero() {
+				n.Time = object.LastModified
+			}
+			objects = append(objects, object)
+			names = append(names, n)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list backup target [%s]: %v", bc.Name, err)
+		}
+		for i, object := range objects {
+			pinned, err := isRemotePinned(backend, &snapshot{Keys: []string{object.Key}}, markers)
+			if err != nil {
+				return fmt.Errorf("failed to check pin of [%s]: %v", object.Key, err)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\n", bc.Name, strings.TrimPrefix(object.Key, prefix), object.Size,
+				names[i].Time.Format(time.RFC3339), pinned)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if c.Bool("versions") {
+			vb, ok := backend.(versionListingBackend)
+			if !ok {
+				return fmt.Errorf("backup target [%s] doesn't support listing versions", bc.Name)
+			}
+			w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "\nNAME\tVERSION\tSIZE\tMODIFIED\tLATEST\tDELETE MARKER")
+			err = vb.ListVersions(prefix, func(v objectVersion) error {
+				if _, err := parseSnapshotName(strings.TrimPrefix(v.Key, prefix)); err != nil {
+					return nil
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\t%t\n", strings.TrimPrefix(v.Key, prefix), v.VersionID, v.Size,
+					v.LastModified.Format(time.RFC3339), v.IsLatest, v.DeleteMarker)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to list versions in backup target [%s]: %v", bc.Name, err)
+			}
+		}
+	}
+	return w.Flush()
+}
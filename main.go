@@ -4,11 +4,14 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,6 +22,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -46,46 +50,7 @@ var (
 	s3Retries     uint = defaultS3Retries
 )
 
-var commonFlags = []cli.Flag{
-	cli.StringFlag{
-		Name:  "endpoints",
-		Usage: "Etcd endpoints",
-		Value: "127.0.0.1:2379",
-	},
-	cli.BoolFlag{
-		Name:   "debug",
-		Usage:  "Verbose logging information for debugging purposes",
-		EnvVar: "RANCHER_DEBUG",
-	},
-	cli.StringFlag{
-		Name:  "name",
-		Usage: "Backup name to take once",
-	},
-	cli.StringFlag{
-		Name:   "cacert",
-		Usage:  "Etcd CA client certificate path",
-		EnvVar: "ETCD_CACERT",
-	},
-	cli.StringFlag{
-		Name:   "cert",
-		Usage:  "Etcd client certificate path",
-		EnvVar: "ETCD_CERT",
-	},
-	cli.StringFlag{
-		Name:   "key",
-		Usage:  "Etcd client key path",
-		EnvVar: "ETCD_KEY",
-	},
-	cli.StringFlag{
-		Name:   "local-endpoint",
-		Usage:  "Local backup download endpoint",
-		EnvVar: "LOCAL_ENDPOINT",
-	},
-	cli.BoolFlag{
-		Name:   "s3-backup",
-		Usage:  "Backup etcd snapshot to your s3 server, set true or false",
-		EnvVar: "S3_BACKUP",
-	},
+var s3Flags = append([]cli.Flag{
 	cli.StringFlag{
 		Name:   "s3-endpoint",
 		Usage:  "Specify s3 endpoint address",
@@ -121,67 +86,110 @@ var commonFlags = []cli.Flag{
 		Usage:  "Specify folder for snapshots",
 		EnvVar: "S3_FOLDER",
 	},
-}
-
-var deleteFlags = []cli.Flag{
 	cli.StringFlag{
-		Name:  "name",
-		Usage: "snapshot name to delete",
+		Name:   "s3-storage-class",
+		Usage:  "Specify s3 storage class for uploaded snapshots",
+		EnvVar: "S3_STORAGE_CLASS",
 	},
-	cli.BoolFlag{
-		Name:  "s3-backup",
-		Usage: "delete snapshot from s3",
+}, append(storageTimeoutFlags, retryFlags...)...)
+
+var commonFlags = append(append([]cli.Flag{
+	cli.StringFlag{
+		Name:  "endpoints",
+		Usage: "Etcd endpoints",
+		Value: "127.0.0.1:2379",
 	},
 	cli.BoolFlag{
-		Name:  "cleanup",
-		Usage: "delete uncompressed files only",
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
 	},
 	cli.StringFlag{
-		Name:   "s3-endpoint",
-		Usage:  "Specify s3 endpoint address",
-		EnvVar: "S3_ENDPOINT",
+		Name:  "name",
+		Usage: "Backup name to take once",
 	},
 	cli.StringFlag{
-		Name:   "s3-accessKey",
-		Usage:  "Specify s3 access key",
-		EnvVar: "S3_ACCESS_KEY",
+		Name:   "cacert",
+		Usage:  "Etcd CA client certificate path",
+		EnvVar: "ETCD_CACERT",
 	},
 	cli.StringFlag{
-		Name:   "s3-secretKey",
-		Usage:  "Specify s3 secret key",
-		EnvVar: "S3_SECRET_KEY",
+		Name:   "cert",
+		Usage:  "Etcd client certificate path",
+		EnvVar: "ETCD_CERT",
 	},
 	cli.StringFlag{
-		Name:   "s3-bucketName",
-		Usage:  "Specify s3 bucket name",
-		EnvVar: "S3_BUCKET_NAME",
+		Name:   "key",
+		Usage:  "Etcd client key path",
+		EnvVar: "ETCD_KEY",
 	},
 	cli.StringFlag{
-		Name:   "s3-region",
-		Usage:  "Specify s3 bucket region",
-		EnvVar: "S3_BUCKET_REGION",
+		Name:   "local-endpoint",
+		Usage:  "Local backup download endpoint",
+		EnvVar: "LOCAL_ENDPOINT",
 	},
-	cli.StringFlag{
-		Name:   "s3-endpoint-ca",
-		Usage:  "Specify custom CA for S3 endpoint. Can be a file path or a base64 string",
-		EnvVar: "S3_ENDPOINT_CA",
+	cli.BoolFlag{
+		Name:   "s3-backup",
+		Usage:  "Backup etcd snapshot to your s3 server, set true or false",
+		EnvVar: "S3_BACKUP",
 	},
+}, etcdTimeoutFlags...), s3Flags...)
+
+var deleteFlags = append(append([]cli.Flag{
 	cli.StringFlag{
-		Name:   "s3-folder",
-		Usage:  "Specify folder for snapshots",
-		EnvVar: "S3_FOLDER",
+		Name:  "name",
+		Usage: "snapshot name to delete",
 	},
-}
+	cli.BoolFlag{
+		Name:  "s3-backup",
+		Usage: "delete snapshot from s3",
+	},
+	cli.BoolFlag{
+		Name:  "cleanup",
+		Usage: "delete uncompressed files only",
+	},
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "delete the snapshot even if it is pinned",
+	},
+	storageTargetsFlag,
+	storageTargetFlag,
+	keepVersionsFlag,
+}, bulkDeleteFlags...), s3Flags...)
 
 type backupConfig struct {
-	Backup     bool
-	Endpoint   string
-	AccessKey  string
-	SecretKey  string
-	BucketName string
-	Region     string
-	EndpointCA string
-	Folder     string
+	Name        string
+	Type        string
+	Path        string
+	Retention   retentionPolicy
+	ClusterID   string
+	ClusterName string
+	// AdoptUnowned applies retention to snapshots without cluster metadata
+	AdoptUnowned bool
+	// KeepVersions is the number of noncurrent versions kept of deleted snapshots, -1 keeps all
+	KeepVersions int
+	Backup       bool
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	BucketName   string
+	Region       string
+	EndpointCA   string
+	Folder       string
+	StorageClass string
+	LockMode     string
+	LockPeriod   time.Duration
+	// Azure Blob Storage, the container is set as BucketName
+	AccountName string
+	AccountKey  string
+	SASToken    string
+	ClientID    string
+	// Google Cloud Storage service account key, a file path or a base64 string
+	CredentialsJSON string
+	// SFTP, the private key and known_hosts are file paths or base64 strings
+	User       string
+	PrivateKey string
+	KnownHosts string
 }
 
 func init() {
@@ -225,8 +233,20 @@ func BackupCommand() cli.Command {
 		},
 	}
 
+	snapshotFlags = append(snapshotFlags, retentionFlags...)
 	snapshotFlags = append(snapshotFlags, commonFlags...)
 
+	downloadFlags := append([]cli.Flag{
+		storageTargetsFlag,
+		storageTargetFlag,
+		cli.BoolFlag{
+			Name:   "stream",
+			Usage:  "Decompress a snapshot downloaded from a storage target while downloading, without storing the archive",
+			EnvVar: "DOWNLOAD_STREAM",
+		},
+	}, urlDownloadFlags...)
+	downloadFlags = append(downloadFlags, commonFlags...)
+
 	return cli.Command{
 		Name:  "etcd-backup",
 		Usage: "Perform etcd backup tools",
@@ -234,7 +254,7 @@ func BackupCommand() cli.Command {
 			{
 				Name:  "save",
 				Usage: "Take snapshot on all etcd hosts and backup to s3 compatible storage",
-				Flags: append(snapshotFlags, cli.UintFlag{
+				Flags: append(append(append(snapshotFlags, cli.UintFlag{
 					Name:        "backup-retries",
 					Usage:       "Number of times to attempt the backup",
 					Destination: &backupRetries,
@@ -242,7 +262,16 @@ func BackupCommand() cli.Command {
 					Name:        "s3-retries",
 					Usage:       "Number of times to attempt the upload to s3",
 					Destination: &s3Retries,
-				}),
+				}, cli.StringFlag{
+					Name:   "s3-object-lock-mode",
+					Usage:  "Lock uploaded snapshots with s3 object lock, set governance or compliance",
+					EnvVar: "S3_OBJECT_LOCK_MODE",
+				}, cli.DurationFlag{
+					Name:   "s3-object-lock-period",
+					Usage:  "Keep uploaded snapshots locked for this time interval, defaults to the retention or the window of its longest keep count",
+					EnvVar: "S3_OBJECT_LOCK_PERIOD",
+				}, storageTargetsFlag, metricsAddressFlag, clusterNameFlag, adoptUnownedFlag, keepVersionsFlag, syncFlag), uploadQueueFlags...),
+					streamUploadFlags...),
 				Action: SaveBackupAction,
 			},
 			{
@@ -253,8 +282,8 @@ func BackupCommand() cli.Command {
 			},
 			{
 				Name:   "download",
-				Usage:  "Download specified snapshot from s3 compatible storage or another local endpoint",
-				Flags:  commonFlags,
+				Usage:  "Download specified snapshot from s3 compatible storage, a URL or another local endpoint",
+				Flags:  downloadFlags,
 				Action: DownloadBackupAction,
 			},
 			{
@@ -263,6 +292,48 @@ func BackupCommand() cli.Command {
 				Flags:  snapshotFlags,
 				Action: ExtractStateFileAction,
 			},
+			{
+				Name:   "hold",
+				Usage:  "Place or release a legal hold on a snapshot in s3 compatible storage",
+				Flags:  holdFlags,
+				Action: HoldBackupAction,
+			},
+			{
+				Name:   "pin",
+				Usage:  "Protect a snapshot from retention locally and in the selected storage target",
+				Flags:  pinFlags,
+				Action: PinBackupAction,
+			},
+			{
+				Name:   "unpin",
+				Usage:  "Remove the protection from retention of a snapshot",
+				Flags:  pinFlags,
+				Action: UnpinBackupAction,
+			},
+			{
+				Name:   "list",
+				Usage:  "List the snapshots in /backup and the selected storage target",
+				Flags:  listFlags,
+				Action: ListBackupAction,
+			},
+			{
+				Name:   "sync",
+				Usage:  "Upload local snapshots missing in the storage targets and optionally download the ones missing locally",
+				Flags:  syncFlags,
+				Action: SyncAction,
+			},
+			{
+				Name:   "prune",
+				Usage:  "Apply the retention to local snapshots and storage targets without taking a snapshot",
+				Flags:  pruneFlags,
+				Action: PruneAction,
+			},
+			{
+				Name:   "lifecycle",
+				Usage:  "Install or update s3 lifecycle rules for snapshots in the configured folder",
+				Flags:  lifecycleFlags,
+				Action: LifecycleAction,
+			},
 			{
 				Name:  "serve",
 				Usage: "Provide HTTPS endpoint to pull local snapshot",
@@ -328,18 +399,26 @@ func SaveBackupAction(c *cli.Context) error {
 		return fmt.Errorf("Failed to find etcd cert or key paths")
 	}
 
-	s3Backup := c.Bool("s3-backup")
-	bc := &backupConfig{
-		Backup:     s3Backup,
-		Endpoint:   c.String("s3-endpoint"),
-		AccessKey:  c.String("s3-accessKey"),
-		SecretKey:  c.String("s3-secretKey"),
-		BucketName: c.String("s3-bucketName"),
-		Region:     c.String("s3-region"),
-		EndpointCA: c.String("s3-endpoint-ca"),
-		Folder:     c.String("s3-folder"),
+	policy, err := newRetentionPolicy(c, retentionPeriod)
+	if err != nil {
+		return err
+	}
+
+	localPolicy, err := localRetentionPolicy(c, policy)
+	if err != nil {
+		return err
+	}
+	targets, err := storageTargets(c, policy)
+	if err != nil {
+		return err
+	}
+
+	streamUpload := c.Bool("stream-upload")
+	if streamUpload && len(targets) == 0 {
+		return fmt.Errorf("stream-upload requires a storage target, set --s3-backup or --storage-targets")
 	}
 
+	ctx := context.Background()
 	if c.Bool("once") {
 		backupName := c.String("name")
 
@@ -347,36 +426,64 @@ func SaveBackupAction(c *cli.Context) error {
 			"name": backupName,
 		}).Info("Initializing Onetime Backup")
 
-		compressedFilePath, err := CreateBackup(backupName, etcdCACert, etcdCert, etcdKey, etcdEndpoints, backupRetries)
-		if err != nil {
-			return err
-		}
-		if bc.Backup {
-			err = CreateS3Backup(backupName, compressedFilePath, bc)
+		if streamUpload {
+			clusterID := lookupClusterID(ctx, etcdEndpoints, etcdCACert, etcdCert, etcdKey)
+			_, errs, err := streamBackup(ctx, backupName, etcdCACert, etcdCert, etcdKey, etcdEndpoints, targets, clusterID,
+				c.String("cluster-name"), c.Bool("stream-local-copy"))
+			if err != nil {
+				return err
+			}
+			if err := targetsError(targets, errs); err != nil {
+				return err
+			}
+		} else {
+			compressedFilePath, err := CreateBackup(ctx, backupName, etcdCACert, etcdCert, etcdKey, etcdEndpoints, backupRetries)
 			if err != nil {
 				return err
 			}
+			setClusterOwner(targets, lookupClusterID(ctx, etcdEndpoints, etcdCACert, etcdCert, etcdKey), c.String("cluster-name"))
+			if err := targetsError(targets, uploadToTargets(ctx, backupName, compressedFilePath, targets)); err != nil {
+				return err
+			}
 		}
 		prefix := getNamePrefix(backupName)
 		// we only clean named backups if we have a retention period and a cluster name prefix
 		if retentionPeriod != 0 && len(prefix) != 0 {
-			if err := DeleteNamedBackups(retentionPeriod, prefix); err != nil {
+			if err := DeleteNamedBackups(localPolicy, prefix); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
+	serveMetrics(c.String("metrics-address"))
+	queue, err := loadUploadQueue(uploadQueueFile, targets, c.Duration("upload-backoff"), c.Duration("upload-max-backoff"), c.Duration("upload-max-age"))
+	if err != nil {
+		return err
+	}
+	go queue.run(ctx, func(target *backupConfig, e *uploadEntry) {
+		if c.Bool("sync") {
+			// Catch up on snapshots missing in the target that aren't queued, like ones taken by an earlier version
+			if queued, err := queuedFiles(uploadQueueFile); err != nil {
+				log.Errorf("Skipping sync of backup target [%s], couldn't read the upload queue: %v", target.Name, err)
+			} else if err := syncTarget(ctx, e.Time, target, localPolicy, queued, false, false); err != nil {
+				log.Errorf("Failed to sync backup target [%s]: %v", target.Name, err)
+			}
+		}
+		DeleteS3Backups(ctx, e.Time, target.Retention, target)
+	})
 	log.WithFields(log.Fields{
 		"creation":  creationPeriod,
-		"retention": retentionPeriod,
+		"retention": localPolicy,
+		"targets":   len(targets),
 	}).Info("Initializing Rolling Backups")
 
+	var clusterID string
 	backupTicker := time.NewTicker(creationPeriod)
 	for {
 		select {
 		case backupTime := <-backupTicker.C:
 			backupName := fmt.Sprintf("%s_etcd", backupTime.Format(time.RFC3339))
-			err := retrieveAndWriteStatefile(backupName)
+			err := retrieveAndWriteStatefile(ctx, backupName)
 			if err != nil {
 				// An error on statefile retrieval is not a reason to bail out
 				// Having a snapshot without a statefile is more valuable than not having a snapshot at all
@@ -385,25 +492,49 @@ func SaveBackupAction(c *cli.Context) error {
 					"error": err,
 				}).Warn("Error while trying to retrieve cluster state from cluster")
 			}
-			compressedFilePath, err := CreateBackup(backupName, etcdCACert, etcdCert, etcdKey, etcdEndpoints, backupRetries)
-			if err != nil {
-				continue
-			}
-			DeleteBackups(backupTime, retentionPeriod)
-			if !bc.Backup {
+			if streamUpload {
+				// The cluster metadata is sent with the upload, so look it up first
+				if len(clusterID) == 0 {
+					clusterID = lookupClusterID(ctx, etcdEndpoints, etcdCACert, etcdCert, etcdKey)
+					queue.setClusterOwner(clusterID, c.String("cluster-name"))
+				}
+				streamRollingBackup(ctx, c, queue, backupName, backupTime, targets, clusterID, localPolicy)
 				continue
 			}
-			err = CreateS3Backup(backupName, compressedFilePath, bc)
+			compressedFilePath, err := CreateBackup(ctx, backupName, etcdCACert, etcdCert, etcdKey, etcdEndpoints, backupRetries)
 			if err != nil {
 				continue
 			}
-			DeleteS3Backups(backupTime, retentionPeriod, bc)
+			if len(clusterID) == 0 {
+				clusterID = lookupClusterID(ctx, etcdEndpoints, etcdCACert, etcdCert, etcdKey)
+				queue.setClusterOwner(clusterID, c.String("cluster-name"))
+			}
+			queue.enqueue(backupName, compressedFilePath, backupTime)
+			DeleteBackups(backupTime, localPolicy)
 		}
 	}
 }
 
-func minioClientFromConfig(bc *backupConfig) (*minio.Client, error) {
-	client, err := setS3Service(bc, true)
+func newBackupConfig(c *cli.Context) *backupConfig {
+	return &backupConfig{
+		Backup:       c.Bool("s3-backup"),
+		Endpoint:     c.String("s3-endpoint"),
+		AccessKey:    c.String("s3-accessKey"),
+		SecretKey:    c.String("s3-secretKey"),
+		BucketName:   c.String("s3-bucketName"),
+		Region:       c.String("s3-region"),
+		EndpointCA:   c.String("s3-endpoint-ca"),
+		Folder:       c.String("s3-folder"),
+		StorageClass: c.String("s3-storage-class"),
+		LockMode:     c.String("s3-object-lock-mode"),
+		LockPeriod:   c.Duration("s3-object-lock-period"),
+		KeepVersions: keepVersions(c),
+		AdoptUnowned: c.Bool("adopt-unowned"),
+	}
+}
+
+func minioClientFromConfig(ctx context.Context, bc *backupConfig) (*minio.Client, error) {
+	client, err := setS3Service(ctx, bc, true)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"s3-endpoint":    bc.Endpoint,
@@ -418,51 +549,62 @@ func minioClientFromConfig(bc *backupConfig) (*minio.Client, error) {
 	return client, nil
 }
 
-func CreateBackup(backupName, etcdCACert, etcdCert, etcdKey, endpoints string, backupRetries uint) (compressedFilePath string, err error) {
-	backupFile := fmt.Sprintf("%s/%s", backupBaseDir, backupName)
-	stateFile := fmt.Sprintf("%s/%s.%s", k8sBaseDir, backupName, clusterStateExtension)
+// checkEtcdHealth fails if the etcd member is unhealthy or doesn't answer in time
+func checkEtcdHealth(ctx context.Context, etcdCACert, etcdCert, etcdKey, endpoints string) error {
 	var data []byte
-	for retries := uint(0); retries <= backupRetries; retries++ {
-		if retries > 0 {
-			time.Sleep(failureInterval)
-		}
-		// check if the cluster is healthy
-		cmd := exec.Command("etcdctl",
+	err := withTimeout(ctx, etcdOperation, timeouts.Etcd, func(ctx context.Context) error {
+		var err error
+		data, err = exec.CommandContext(ctx, "etcdctl",
 			fmt.Sprintf("--endpoints=%s", endpoints),
 			"--cacert="+etcdCACert,
 			"--cert="+etcdCert,
 			"--key="+etcdKey,
-			"endpoint", "health")
-		data, err = cmd.CombinedOutput()
+			"endpoint", "health").CombinedOutput()
+		return err
+	})
 
-		if strings.Contains(string(data), "unhealthy") {
-			log.WithFields(log.Fields{
-				"error": err,
-				"data":  string(data),
-			}).Warn("Checking member health failed from etcd member")
-			err = fmt.Errorf("%s: %v", err, string(data))
-			continue
+	if isTimeout(err) || strings.Contains(string(data), "unhealthy") {
+		log.WithFields(log.Fields{
+			"error": err,
+			"data":  string(data),
+		}).Warn("Checking member health failed from etcd member")
+		if err == nil {
+			return fmt.Errorf("etcd member is unhealthy: %s", string(data))
 		}
+		return fmt.Errorf("%w: %s", err, string(data))
+	}
+	return nil
+}
 
-		cmd = exec.Command("etcdctl",
-			fmt.Sprintf("--endpoints=%s", endpoints),
-			"--cacert="+etcdCACert,
-			"--cert="+etcdCert,
-			"--key="+etcdKey,
-			"snapshot", "save", backupFile)
+func CreateBackup(ctx context.Context, backupName, etcdCACert, etcdCert, etcdKey, endpoints string, backupRetries uint) (compressedFilePath string, err error) {
+	backupFile := fmt.Sprintf("%s/%s", backupBaseDir, backupName)
+	stateFile := fmt.Sprintf("%s/%s.%s", k8sBaseDir, backupName, clusterStateExtension)
+	err = retry(ctx, snapshotOperation, backupRetries, func(attempt uint) error {
+		if err := checkEtcdHealth(ctx, etcdCACert, etcdCert, etcdKey, endpoints); err != nil {
+			return err
+		}
 
+		var data []byte
 		startTime := time.Now()
-		data, err = cmd.CombinedOutput()
+		err := withTimeout(ctx, snapshotOperation, timeouts.Snapshot, func(ctx context.Context) error {
+			var err error
+			data, err = exec.CommandContext(ctx, "etcdctl",
+				fmt.Sprintf("--endpoints=%s", endpoints),
+				"--cacert="+etcdCACert,
+				"--cert="+etcdCert,
+				"--key="+etcdKey,
+				"snapshot", "save", backupFile).CombinedOutput()
+			return err
+		})
 		endTime := time.Now()
 
 		if err != nil {
 			log.WithFields(log.Fields{
-				"attempt": retries + 1,
+				"attempt": attempt + 1,
 				"error":   err,
 				"data":    string(data),
 			}).Warn("Backup failed")
-			err = fmt.Errorf("%s: %v", err, string(data))
-			continue
+			return fmt.Errorf("%w: %s", err, string(data))
 		}
 		// Determine how many files need to be in the compressed file
 		// 1. the compressed file
@@ -475,29 +617,28 @@ func CreateBackup(backupName, etcdCACert, etcdCert, etcdKey, endpoints string, b
 		compressedFilePath, err = compressFiles(backupFile, toCompressFiles)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"attempt": retries + 1,
+				"attempt": attempt + 1,
 				"error":   err,
 				"data":    string(data),
 			}).Warn("Compressing backup failed")
-			continue
+			return err
 		}
 		// Remove the original file after successfully compressing it
 		err = os.Remove(backupFile)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"attempt": retries + 1,
+				"attempt": attempt + 1,
 				"error":   err,
 				"data":    string(data),
 			}).Warn("Removing uncompressed snapshot file failed")
-			continue
-
+			return err
 		}
 		// Remove the state file after successfully compressing it
 		if _, err = os.Stat(stateFile); err == nil {
 			err = os.Remove(stateFile)
 			if err != nil {
 				log.WithFields(log.Fields{
-					"attempt": retries + 1,
+					"attempt": attempt + 1,
 					"error":   err,
 					"data":    string(data),
 				}).Warn("Removing statefile failed")
@@ -511,49 +652,64 @@ func CreateBackup(backupName, etcdCACert, etcdCert, etcdKey, endpoints string, b
 
 		if err = os.Chmod(compressedFilePath, 0600); err != nil {
 			log.WithFields(log.Fields{
-				"attempt": retries + 1,
+				"attempt": attempt + 1,
 				"error":   err,
 				"data":    string(data),
 			}).Warn("changing permission of the compressed snapshot failed")
-			continue
+			return err
 		}
-		break
-	}
+		return nil
+	})
 	return
 }
 
-func CreateS3Backup(backupName, compressedFilePath string, bc *backupConfig) error {
-	// If the minio client doesn't work now, it won't after retrying
-	client, err := minioClientFromConfig(bc)
+func CreateS3Backup(ctx context.Context, backupName, compressedFilePath string, bc *backupConfig) error {
+	return uploadSnapshot(ctx, backupName, compressedFilePath, bc, s3Retries)
+}
+
+// uploadSnapshot uploads the snapshot to the target unless it is there already, trying retries more times
+func uploadSnapshot(ctx context.Context, backupName, compressedFilePath string, bc *backupConfig, retries uint) error {
+	// If the storage backend doesn't work now, it won't after retrying
+	backend, err := newStorageBackend(ctx, bc)
 	if err != nil {
 		return err
 	}
-	compressedFile := filepath.Base(compressedFilePath)
+	defer closeStorageBackend(backend)
 	// If folder is specified, prefix the file with the folder
-	if len(bc.Folder) != 0 {
-		compressedFile = fmt.Sprintf("%s/%s", bc.Folder, compressedFile)
-	}
+	compressedFile := folderKey(bc, filepath.Base(compressedFilePath))
 	// check if it exists already in the bucket, and if versioning is disabled on the bucket. If an error is detected,
 	// assume we aren't privy to that information and do multiple uploads anyway.
-	info, _ := client.StatObject(context.TODO(), bc.BucketName, compressedFile, minio.StatObjectOptions{})
+	info, _ := backend.Stat(compressedFile)
 	if info.Size != 0 {
-		versioning, _ := client.GetBucketVersioning(context.TODO(), bc.BucketName)
-		if !versioning.Enabled() {
+		if vb, ok := backend.(versionedBackend); !ok || !vb.Versioned() {
 			log.WithFields(log.Fields{
-				"name": backupName,
-			}).Info("Skipping upload to s3 because snapshot already exists and versioning is not enabled for the bucket")
+				"name":   backupName,
+				"target": bc.Name,
+			}).Info("Skipping upload because snapshot already exists and versioning is not enabled for the target")
 			return nil
 		}
 	}
 
-	err = uploadBackupFile(client, bc.BucketName, compressedFile, compressedFilePath, s3Retries)
+	err = uploadBackupFile(ctx, backend, compressedFile, compressedFilePath, retries)
 	if err != nil {
 		return err
 	}
+	// Retention leaves manual snapshots alone, a lifecycle rule doesn't
+	if n, err := parseSnapshotName(filepath.Base(compressedFilePath)); err != nil || !n.recurring() {
+		if eb, ok := backend.(expiringBackend); ok {
+			if rule, err := eb.ExpiryRule(compressedFile); err == nil && len(rule) != 0 {
+				log.WithFields(log.Fields{
+					"name":   backupName,
+					"target": bc.Name,
+					"rule":   rule,
+				}).Warn("Manual snapshot will be expired by a lifecycle rule of the target")
+			}
+		}
+	}
 	return nil
 }
 
-func DeleteBackups(backupTime time.Time, retentionPeriod time.Duration) {
+func DeleteBackups(backupTime time.Time, policy retentionPolicy) {
 	files, err := os.ReadDir(backupBaseDir)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -562,8 +718,7 @@ func DeleteBackups(backupTime time.Time, retentionPeriod time.Duration) {
 		}).Warn("Can't read backup directory")
 	}
 
-	cutoffTime := backupTime.Add(retentionPeriod * -1)
-
+	snapshots := newSnapshotSet()
 	for _, file := range files {
 		if file.IsDir() {
 			log.WithFields(log.Fields{
@@ -572,15 +727,55 @@ func DeleteBackups(backupTime time.Time, retentionPeriod time.Duration) {
 			continue
 		}
 
-		backupTime, err2 := time.Parse(time.RFC3339, strings.Split(file.Name(), "_")[0])
+		if !isSnapshotFile(file.Name()) {
+			continue
+		}
+		n, err2 := parseSnapshotName(file.Name())
 		if err2 != nil {
 			log.WithFields(log.Fields{
 				"name":  file.Name(),
 				"error": err2,
 			}).Warn("Couldn't parse backup")
+			continue
+		}
+		if !n.recurring() {
+			continue
+		}
+		fi, err := file.Info()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"name":  file.Name(),
+				"error": err,
+			}).Warn("Couldn't stat backup")
+			continue
+		}
+		if n.Time.IsZero() {
+			n.Time = fi.ModTime()
+		}
+		snapshots.add(n, file.Name(), fi.Size())
+	}
 
-		} else if backupTime.Before(cutoffTime) {
-			_ = deleteBackup(file.Name())
+	unpinned := withoutPinned(backupBaseDir, snapshots.snapshots, func(s *snapshot) (bool, error) {
+		return isLocalPinned(s.Name), nil
+	})
+	queued, err := queuedFiles(uploadQueueFile)
+	if err != nil {
+		// Keep every snapshot when in doubt
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Skipping local retention, couldn't check the upload queue")
+		return
+	}
+	unqueued := withoutQueued(unpinned, queued)
+	expired := policy.expiredByGroup(backupTime, unqueued)
+	recordRetention(backupBaseDir, policy, unqueued, expired)
+	for _, s := range expired {
+		if policy.DryRun {
+			logDryRun(backupBaseDir, s)
+			continue
+		}
+		for _, name := range s.Keys {
+			_ = deleteBackup(name)
 		}
 	}
 }
@@ -601,6 +796,7 @@ func deleteBackup(fileName string) error {
 		}).Warn("Delete local backup failed")
 		return err2
 	}
+	os.Remove(checksumPath(toDelete))
 	log.WithFields(log.Fields{
 		"name":    fileName,
 		"runtime": endTime.Sub(startTime),
@@ -608,23 +804,23 @@ func deleteBackup(fileName string) error {
 	return nil
 }
 
-func DeleteS3Backups(backupTime time.Time, retentionPeriod time.Duration, bc *backupConfig) {
+func DeleteS3Backups(ctx context.Context, backupTime time.Time, policy retentionPolicy, bc *backupConfig) {
 	log.WithFields(log.Fields{
-		"retention": retentionPeriod,
+		"retention": policy,
+		"target":    bc.Name,
 	}).Info("Invoking delete s3 backup files")
-	var backupDeleteList []string
-	client, err := minioClientFromConfig(bc)
+	backend, err := newStorageBackend(ctx, bc)
 	if err != nil {
-		// An error on setting minio client is not a reason to bail out
+		// An error on setting the storage backend is not a reason to bail out
 		// Having a snapshot without an upload to s3 is more valuable than not having a snapshot at all
 		log.WithFields(log.Fields{
 			"error": err,
-		}).Warn("Error while trying to configure minio client")
+		}).Warn("Error while trying to configure storage backend")
 		return
 	}
+	defer closeStorageBackend(backend)
 
-	cutoffTime := backupTime.Add(retentionPeriod * -1)
-
+	snapshots := newSnapshotSet()
 	isRecursive := false
 	prefix := ""
 	if len(bc.Folder) != 0 {
@@ -632,63 +828,141 @@ func DeleteS3Backups(backupTime time.Time, retentionPeriod time.Duration, bc *ba
 		// Recurse will show us the files in the folder
 		isRecursive = true
 	}
-	objectCh := client.ListObjects(context.TODO(), bc.BucketName, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: isRecursive,
-	})
-	re := regexp.MustCompile(fmt.Sprintf(".+_etcd(|.%s)$", compressedExtension))
-	for object := range objectCh {
-		if object.Err != nil {
-			log.Error("error to fetch s3 file:", object.Err)
-			return
+	markers := map[string]bool{}
+	err = backend.List(prefix, isRecursive, func(object objectInfo) error {
+		if strings.HasSuffix(object.Key, fmt.Sprintf(".%s", pinnedExtension)) {
+			markers[object.Key] = true
+			return nil
 		}
-		// only parse backup file names that matches *_etcd format
-		if re.MatchString(object.Key) {
-			filename := object.Key
+		filename := object.Key
 
-			if len(bc.Folder) != 0 {
-				// example object.Key with folder: folder/timestamp_etcd.zip
-				// folder and separator needs to be stripped so time can be parsed below
-				log.Debugf("Stripping [%s] from [%s]", fmt.Sprintf("%s/", prefix), filename)
-				filename = strings.TrimPrefix(filename, fmt.Sprintf("%s/", prefix))
-			}
-			log.Debugf("object.Key: [%s], filename: [%s]", object.Key, filename)
+		if len(bc.Folder) != 0 {
+			// example object.Key with folder: folder/timestamp_etcd.zip
+			// folder and separator needs to be stripped so time can be parsed below
+			log.Debugf("Stripping [%s] from [%s]", fmt.Sprintf("%s/", prefix), filename)
+			filename = strings.TrimPrefix(filename, fmt.Sprintf("%s/", prefix))
+		}
+		log.Debugf("object.Key: [%s], filename: [%s]", object.Key, filename)
 
-			backupTime, err := time.Parse(time.RFC3339, strings.Split(filename, "_")[0])
+		// only handle rolling and recurring named snapshots
+		n, err := parseSnapshotName(filename)
+		if err != nil {
+			log.Debugf("Skipping [%s]: %v", object.Key, err)
+			return nil
+		}
+		if !n.recurring() {
+			return nil
+		}
+		if n.Time.IsZero() {
+			n.Time = object.LastModified
+		}
+		// We use object.Key here as we need the full path when a folder is used
+		snapshots.add(n, object.Key, object.Size)
+		return nil
+	})
+	if err != nil {
+		// A time based policy decides on every snapshot on its own, the ones listed so far can still be handled
+		if !policy.perSnapshot() {
+			log.Error("error to fetch s3 file:", err)
+			return
+		}
+		log.Errorf("error to fetch s3 file, continuing with the %d snapshots listed: %v", len(snapshots.snapshots), err)
+	}
+	// Pinned snapshots and snapshots of other clusters are left out of the policy, so they don't take the place of
+	// this cluster's snapshots in MinKeep
+	owned, expired := policy.expiredWithout(backupTime, snapshots.snapshots, func(candidates []*snapshot) []*snapshot {
+		unpinned := withoutPinned(bc.Name, candidates, func(s *snapshot) (bool, error) {
+			return isRemotePinned(backend, s, markers)
+		})
+		return withoutForeign(backend, bc, unpinned)
+	})
+	recordRetention(bc.Name, policy, owned, expired)
+	log.Debugf("Found %d snapshots to delete", len(expired))
+
+	var keys []string
+	for _, s := range expired {
+		keys = append(keys, s.Keys...)
+	}
+	// Removing a locked object on a versioned bucket would only add a delete marker, skip it instead
+	var locked []string
+	if lb, ok := backend.(lockingBackend); ok {
+		lockReasons := map[string]string{}
+		var mu sync.Mutex
+		forEachConcurrent(keys, func(key string) {
+			reason, err := lb.LockReason(key)
 			if err != nil {
+				reason = fmt.Sprintf("failed to check object lock: %v", err)
+			}
+			mu.Lock()
+			lockReasons[key] = reason
+			mu.Unlock()
+		})
+		var unlocked []string
+		for _, key := range keys {
+			if reason := lockReasons[key]; len(reason) != 0 {
 				log.WithFields(log.Fields{
-					"name":      filename,
-					"objectKey": object.Key,
-					"error":     err,
-				}).Warn("Couldn't parse s3 backup")
-
-			} else if backupTime.Before(cutoffTime) {
-				// We use object.Key here as we need the full path when a folder is used
-				log.Debugf("Adding [%s] to files to delete, backupTime: [%q], cutoffTime: [%q]", object.Key, backupTime, cutoffTime)
-				backupDeleteList = append(backupDeleteList, object.Key)
+					"name":   key,
+					"reason": reason,
+				}).Warn("Skipping deletion of locked s3 backup file")
+				locked = append(locked, key)
+				continue
 			}
+			unlocked = append(unlocked, key)
 		}
+		keys = unlocked
 	}
-	log.Debugf("Found %d files to delete", len(backupDeleteList))
 
-	for i := range backupDeleteList {
-		log.Infof("Start to delete s3 backup file [%s]", backupDeleteList[i])
-		err := client.RemoveObject(context.TODO(), bc.BucketName, backupDeleteList[i], minio.RemoveObjectOptions{})
-		if err != nil {
-			log.Errorf("Error detected during deletion: %v", err)
-		} else {
-			log.Infof("Success delete s3 backup file [%s]", backupDeleteList[i])
+	if policy.DryRun {
+		deletable := map[string]bool{}
+		for _, key := range keys {
+			deletable[key] = true
 		}
+		for _, s := range expired {
+			for _, key := range s.Keys {
+				if deletable[key] {
+					logDryRun(bc.Name, expiredSnapshot{snapshot: &snapshot{Name: s.Name, Time: s.Time, Keys: []string{key}}, Reason: s.Reason})
+				}
+			}
+		}
+		return
 	}
+
+	var failed int
+	if len(keys) != 0 {
+		log.Infof("Start to delete %d s3 backup files", len(keys))
+		errs := deleteKeys(backend, keys)
+		var deleted []string
+		for _, key := range keys {
+			if err := errs[key]; err != nil {
+				log.Errorf("Error detected during deletion of [%s]: %v", key, err)
+				failed++
+				continue
+			}
+			deleted = append(deleted, key)
+		}
+		pruneVersions(backend, bc, deleted, bc.KeepVersions)
+	}
+	log.WithFields(log.Fields{
+		"target":  bc.Name,
+		"expired": len(expired),
+		"deleted": len(keys) - failed,
+		"failed":  failed,
+		"locked":  len(locked),
+	}).Info("Finished deleting s3 backup files")
 }
 
 func DeleteBackupAction(c *cli.Context) error {
+	if c.Bool("bulk") {
+		return BulkDeleteAction(c)
+	}
 	name := c.String("name")
 	if name == "" {
 		return fmt.Errorf("snapshot name is required")
 	}
 	compressedPath := fmt.Sprintf("/backup/%s.%s", name, compressedExtension)
 	uncompressedPath := fmt.Sprintf("/backup/%s", name)
+	snapshotName := strings.TrimSuffix(name, fmt.Sprintf(".%s", compressedExtension))
+	force := c.Bool("force")
 
 	// Since we have to support compressed and uncompressed versions of snapshots.
 	// We can't remove the uncompressed snapshot during cleanup unless we are
@@ -699,71 +973,45 @@ func DeleteBackupAction(c *cli.Context) error {
 			// we don't need to go to s3
 			return deleteBackup(uncompressedPath)
 		}
-	} else {
-		for _, p := range []string{compressedPath, uncompressedPath} {
-			if err := deleteBackup(p); err != nil {
-				return err
-			}
+	} else if isLocalPinned(snapshotName) {
+		if !force {
+			return fmt.Errorf("snapshot [%s] is pinned, unpin it or set --force to delete it", snapshotName)
 		}
-	}
-
-	if !c.Bool("s3-backup") {
-		return nil
-	}
-
-	bc := &backupConfig{
-		Endpoint:   c.String("s3-endpoint"),
-		AccessKey:  c.String("s3-accessKey"),
-		SecretKey:  c.String("s3-secretKey"),
-		BucketName: c.String("s3-bucketName"),
-		Region:     c.String("s3-region"),
-		EndpointCA: c.String("s3-endpoint-ca"),
-		Folder:     c.String("s3-folder"),
-	}
-	client, err := setS3Service(bc, true)
-	if err != nil {
 		log.WithFields(log.Fields{
-			"s3-endpoint":    bc.Endpoint,
-			"s3-bucketName":  bc.BucketName,
-			"s3-accessKey":   bc.AccessKey,
-			"s3-region":      bc.Region,
-			"s3-endpoint-ca": bc.EndpointCA,
-			"s3-folder":      bc.Folder,
-		}).Errorf("failed to set s3 server: %s", err)
-		return fmt.Errorf("failed to set s3 server: %+v", err)
-	}
-	folder := c.String("s3-folder")
-	if len(folder) != 0 {
-		name = fmt.Sprintf("%s/%s", folder, name)
+			"name": snapshotName,
+		}).Warn("Deleting pinned local snapshot")
 	}
 
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-	// list objects with prefix=name, this will include uncompressed and compressed backup objects
-	objectCh := client.ListObjects(context.TODO(), bc.BucketName, minio.ListObjectsOptions{
-		Prefix:    name,
-		Recursive: false,
-	})
-	var removed []string
-	for object := range objectCh {
-		if object.Err != nil {
-			log.Errorf("failed to list objects in backup buckets [%s]: %v", bc.BucketName, object.Err)
-			return object.Err
-		}
-		log.Infof("deleting object with key: %s that matches prefix: %s", object.Key, name)
-		err = client.RemoveObject(context.TODO(), bc.BucketName, object.Key, minio.RemoveObjectOptions{})
+	// The target is handled first, so a snapshot pinned there isn't left without its local copy
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
+		bc, err := selectedStorageTarget(c)
 		if err != nil {
 			return err
 		}
-		removed = append(removed, object.Key)
-	}
+		ctx := context.Background()
+		backend, err := newStorageBackend(ctx, bc)
+		if err != nil {
+			return err
+		}
+		defer closeStorageBackend(backend)
 
-	log.Infof("removed backups: %s from object store", strings.Join(removed, ", "))
+		if err := deleteSnapshotKeys(backend, bc, snapshotName, force); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	if c.Bool("cleanup") {
+		return nil
+	}
+	for _, p := range []string{compressedPath, uncompressedPath} {
+		if err := deleteBackup(p); err != nil {
+			return err
+		}
+	}
+	return setLocalPinned(snapshotName, false)
 }
 
-func setS3Service(bc *backupConfig, useSSL bool) (*minio.Client, error) {
+func setS3Service(ctx context.Context, bc *backupConfig, useSSL bool) (*minio.Client, error) {
 	// Initialize minio client object.
 	log.WithFields(log.Fields{
 		"s3-endpoint":    bc.Endpoint,
@@ -785,52 +1033,52 @@ func setS3Service(bc *backupConfig, useSSL bool) (*minio.Client, error) {
 		}
 	}
 	bucketLookup := getBucketLookupType(bc.Endpoint)
-	for retries := 0; retries <= defaultS3Retries; retries++ {
-		// if the s3 access key and secret is not set use iam role
-		if len(bc.AccessKey) == 0 && len(bc.SecretKey) == 0 {
-			log.Info("invoking set s3 service client use IAM role")
-			cred = credentials.NewIAM("")
-			if bc.Endpoint == "" {
-				bc.Endpoint = s3Endpoint
-			}
-		} else {
-			// Base64 decoding S3 accessKey and secretKey before create static credentials
-			// To be backward compatible, just updating base64 encoded values
-			accessKey := bc.AccessKey
-			secretKey := bc.SecretKey
-			if len(accessKey) > 0 {
-				v, err := base64.StdEncoding.DecodeString(accessKey)
-				if err == nil {
-					accessKey = string(v)
-				}
-			}
-			if len(secretKey) > 0 {
-				v, err := base64.StdEncoding.DecodeString(secretKey)
-				if err == nil {
-					secretKey = string(v)
-				}
+	// if the s3 access key and secret is not set use iam role
+	if len(bc.AccessKey) == 0 && len(bc.SecretKey) == 0 {
+		log.Info("invoking set s3 service client use IAM role")
+		cred = credentials.NewIAM("")
+		if bc.Endpoint == "" {
+			bc.Endpoint = s3Endpoint
+		}
+	} else {
+		// Base64 decoding S3 accessKey and secretKey before create static credentials
+		// To be backward compatible, just updating base64 encoded values
+		accessKey := bc.AccessKey
+		secretKey := bc.SecretKey
+		if len(accessKey) > 0 {
+			v, err := base64.StdEncoding.DecodeString(accessKey)
+			if err == nil {
+				accessKey = string(v)
 			}
-			cred = credentials.NewStatic(accessKey, secretKey, "", credentials.SignatureDefault)
-		}
-		client, err = minio.New(bc.Endpoint, &minio.Options{
-			Creds:        cred,
-			Secure:       useSSL,
-			Region:       bc.Region,
-			BucketLookup: bucketLookup,
-			Transport:    tr,
-		})
-		if err != nil {
-			log.Infof("failed to init s3 client server: %v, retried %d times", err, retries)
-			if retries >= defaultS3Retries {
-				return nil, fmt.Errorf("failed to set s3 server: %v", err)
+		}
+		if len(secretKey) > 0 {
+			v, err := base64.StdEncoding.DecodeString(secretKey)
+			if err == nil {
+				secretKey = string(v)
 			}
-			continue
 		}
-
-		break
+		cred = credentials.NewStatic(accessKey, secretKey, "", credentials.SignatureDefault)
+	}
+	// minio.New doesn't connect yet, an invalid configuration won't get better by retrying
+	client, err = minio.New(bc.Endpoint, &minio.Options{
+		Creds:        cred,
+		Secure:       useSSL,
+		Region:       bc.Region,
+		BucketLookup: bucketLookup,
+		Transport:    tr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set s3 server: %v", err)
 	}
 
-	found, err := client.BucketExists(context.TODO(), bc.BucketName)
+	var found bool
+	err = retry(ctx, requestOperation, s3Retries, func(uint) error {
+		return withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			var err error
+			found, err = client.BucketExists(ctx, bc.BucketName)
+			return err
+		})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to check s3 bucket:%s, err:%v", bc.BucketName, err)
 	}
@@ -850,26 +1098,46 @@ func getBucketLookupType(endpoint string) minio.BucketLookupType {
 	return minio.BucketLookupAuto
 }
 
-func uploadBackupFile(svc *minio.Client, bucketName, fileName, filePath string, s3Retries uint) error {
-	var info minio.UploadInfo
-	var err error
-	// Upload the zip file with FPutObject
+func putObjectOptions(bc *backupConfig) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		ContentType:  contentType,
+		StorageClass: bc.StorageClass,
+		UserMetadata: snapshotMetadata(bc),
+	}
+	if len(bc.LockMode) != 0 {
+		opts.Mode = minio.RetentionMode(strings.ToUpper(bc.LockMode))
+		opts.RetainUntilDate = time.Now().Add(bc.LockPeriod).UTC()
+	}
+	return opts
+}
+
+func uploadBackupFile(ctx context.Context, backend storageBackend, fileName, filePath string, s3Retries uint) error {
+	// Upload the zip file
 	log.Infof("invoking uploading backup file [%s] to s3", fileName)
-	for i := uint(0); i <= s3Retries; i++ {
-		info, err = svc.FPutObject(context.TODO(), bucketName, fileName, filePath, minio.PutObjectOptions{ContentType: contentType})
-		if err == nil {
-			log.Infof("Successfully uploaded [%s] of size [%d]", fileName, info.Size)
-			return nil
+	err := retry(ctx, uploadOperation, s3Retries, func(uint) error {
+		if err := backend.Put(fileName, filePath); err != nil {
+			return err
 		}
-		log.Infof("failed to upload etcd snapshot file: %v, retried %d times", err, i)
+		return verifyUpload(backend, fileName, filePath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload etcd snapshot file: %v", err)
+	}
+	var size int64
+	if fi, err := os.Stat(filePath); err == nil {
+		size = fi.Size()
 	}
-	return fmt.Errorf("failed to upload etcd snapshot file: %v", err)
+	log.Infof("Successfully uploaded [%s] of size [%d]", fileName, size)
+	return nil
 }
 
 func DownloadBackupAction(c *cli.Context) error {
 	log.Info("Initializing Download Backups")
 	SetLoggingLevel(c.Bool("debug"))
-	if c.Bool("s3-backup") {
+	if len(c.String("url")) != 0 {
+		return DownloadURLBackup(c)
+	}
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
 		return DownloadS3Backup(c)
 	}
 	return DownloadLocalBackup(c)
@@ -879,7 +1147,7 @@ func ExtractStateFileAction(c *cli.Context) error {
 	SetLoggingLevel(c.Bool("debug"))
 	name := path.Base(c.String("name"))
 	log.Infof("Trying to get statefile from backup [%s]", name)
-	if c.Bool("s3-backup") {
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
 		err := DownloadS3Backup(c)
 		if err != nil {
 			return err
@@ -904,52 +1172,44 @@ func ExtractStateFileAction(c *cli.Context) error {
 }
 
 func DownloadS3Backup(c *cli.Context) error {
-	bc := &backupConfig{
-		Endpoint:   c.String("s3-endpoint"),
-		AccessKey:  c.String("s3-accessKey"),
-		SecretKey:  c.String("s3-secretKey"),
-		BucketName: c.String("s3-bucketName"),
-		Region:     c.String("s3-region"),
-		EndpointCA: c.String("s3-endpoint-ca"),
-		Folder:     c.String("s3-folder"),
-	}
-	client, err := setS3Service(bc, true)
+	bc, err := selectedStorageTarget(c)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"s3-endpoint":    bc.Endpoint,
-			"s3-bucketName":  bc.BucketName,
-			"s3-accessKey":   bc.AccessKey,
-			"s3-region":      bc.Region,
-			"s3-endpoint-ca": bc.EndpointCA,
-			"s3-folder":      bc.Folder,
-		}).Errorf("failed to set s3 server: %s", err)
-		return fmt.Errorf("failed to set s3 server: %+v", err)
+		return err
+	}
+	ctx := context.Background()
+	backend, err := newStorageBackend(ctx, bc)
+	if err != nil {
+		return err
 	}
+	defer closeStorageBackend(backend)
 
 	prefix := c.String("name")
 	if len(prefix) == 0 {
 		return fmt.Errorf("empty backup name")
 	}
-	folder := c.String("s3-folder")
-	if len(folder) != 0 {
-		prefix = fmt.Sprintf("%s/%s", folder, prefix)
-	}
+	prefix = folderKey(bc, prefix)
 	// we need download with prefix because we don't know if the file is ziped or not
-	filename, err := downloadFromS3WithPrefix(client, prefix, bc.BucketName)
+	filename, err := downloadFromS3WithPrefix(ctx, backend, prefix, c.Bool("stream"))
 	if err != nil {
 		return err
 	}
-	if isCompressed(filename) {
-		log.Infof("Decompressing etcd snapshot file [%s]", filename)
-		compressedFilePath := fmt.Sprintf("%s/%s", backupBaseDir, filename)
-		fileLocation := fmt.Sprintf("%s/%s", backupBaseDir, decompressedName(filename))
-		err := decompressFile(compressedFilePath, fileLocation, fileLocation)
-		if err != nil {
-			return fmt.Errorf("Unable to decompress [%s] to [%s]: %v", compressedFilePath, fileLocation, err)
-		}
+	return decompressDownloadedBackup(filename)
+}
 
-		log.Infof("Decompressed [%s] to [%s]", compressedFilePath, fileLocation)
+// decompressDownloadedBackup extracts the snapshot next to a downloaded archive in the backup directory
+func decompressDownloadedBackup(filename string) error {
+	if !isCompressed(filename) {
+		return nil
 	}
+	log.Infof("Decompressing etcd snapshot file [%s]", filename)
+	compressedFilePath := fmt.Sprintf("%s/%s", backupBaseDir, filename)
+	fileLocation := fmt.Sprintf("%s/%s", backupBaseDir, decompressedName(filename))
+	err := decompressFile(compressedFilePath, fileLocation, fileLocation)
+	if err != nil {
+		return fmt.Errorf("Unable to decompress [%s] to [%s]: %v", compressedFilePath, fileLocation, err)
+	}
+
+	log.Infof("Decompressed [%s] to [%s]", compressedFilePath, fileLocation)
 	return nil
 }
 
@@ -974,38 +1234,58 @@ func DownloadLocalBackup(c *cli.Context) error {
 	snapshotURL := fmt.Sprintf("https://%s:%s/%s", endpoint, serverPort, snapshot)
 	log.Infof("Invoking downloading backup files: %s", snapshot)
 	log.Infof("Trying to download backup file from: %s", snapshotURL)
-	resp, err := client.Get(snapshotURL)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Errorf("backup download failed: %v", resp.Body)
-		return fmt.Errorf("backup download failed: %v", resp.Body)
-	}
-	defer resp.Body.Close()
-
 	snapshotFileLocation := fmt.Sprintf("%s/%s", backupBaseDir, snapshot)
-	snapshotFile, err := os.Create(snapshotFileLocation)
+	// The snapshot is written to a hidden file first, so a failed or timed out download never shows up as a snapshot
+	partialPath := fmt.Sprintf("%s/.%s.%s", backupBaseDir, snapshot, partialExtension)
+	defer os.Remove(partialPath)
+	var checksum string
+	err = withTimeout(context.Background(), downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, snapshotURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Errorf("backup download failed: %s", resp.Status)
+			return fmt.Errorf("backup download failed: %w", &statusError{Status: resp.Status, StatusCode: resp.StatusCode})
+		}
+		checksum = resp.Header.Get(checksumHeader)
+
+		snapshotFile, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer snapshotFile.Close()
+
+		if _, err = io.Copy(snapshotFile, resp.Body); err != nil {
+			return err
+		}
+		return snapshotFile.Close()
+	})
 	if err != nil {
 		return err
 	}
-	defer snapshotFile.Close()
 
-	if _, err := io.Copy(snapshotFile, resp.Body); err != nil {
+	// Older nodes serve snapshots without a checksum
+	if len(checksum) == 0 {
+		log.Warnf("No checksum served for [%s], skipping verification", snapshot)
+	} else if err := verifyChecksum(partialPath, checksum); err != nil {
 		return err
 	}
 
-	if err := os.Chmod(snapshotFileLocation, 0600); err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Warn("changing permission of the locally downloaded snapshot failed")
+	if err := os.Rename(partialPath, snapshotFileLocation); err != nil {
+		return err
 	}
 
 	log.Infof("Successfully download %s from %s ", snapshot, endpoint)
 	return nil
 }
 
-func DeleteNamedBackups(retentionPeriod time.Duration, prefix string) error {
+func DeleteNamedBackups(policy retentionPolicy, prefix string) error {
 	files, err := os.ReadDir(backupBaseDir)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -1014,14 +1294,36 @@ func DeleteNamedBackups(retentionPeriod time.Duration, prefix string) error {
 		}).Warn("Can't read backup directory")
 		return err
 	}
-	cutoffTime := time.Now().Add(retentionPeriod * -1)
+	snapshots := newSnapshotSet()
 	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), prefix) || strings.HasSuffix(file.Name(), fmt.Sprintf(".%s", pinnedExtension)) {
+			continue
+		}
+		n, err := parseSnapshotName(file.Name())
+		if err != nil || n.Rolling || !n.recurring() {
+			continue
+		}
 		fi, err := file.Info()
 		if err != nil {
 			return fmt.Errorf("failed to get file info: %w", err)
 		}
-		if strings.HasPrefix(file.Name(), prefix) && fi.ModTime().Before(cutoffTime) && IsRecurringSnapshot(file.Name()) {
-			if err = deleteBackup(file.Name()); err != nil {
+		if n.Time.IsZero() {
+			n.Time = fi.ModTime()
+		}
+		snapshots.add(n, file.Name(), fi.Size())
+	}
+	unpinned := withoutPinned(backupBaseDir, snapshots.snapshots, func(s *snapshot) (bool, error) {
+		return isLocalPinned(s.Name), nil
+	})
+	expired := policy.expiredByGroup(time.Now(), unpinned)
+	recordRetention(backupBaseDir, policy, unpinned, expired)
+	for _, s := range expired {
+		if policy.DryRun {
+			logDryRun(backupBaseDir, s)
+			continue
+		}
+		for _, name := range s.Keys {
+			if err = deleteBackup(name); err != nil {
 				return err
 			}
 		}
@@ -1071,8 +1373,14 @@ func ServeBackupAction(c *cli.Context) error {
 		TLSConfig: tlsConfig,
 	}
 
+	// The checksum lets the downloading node verify the transfer
+	sum, err := fileSHA256(fileLocation)
+	if err != nil {
+		return err
+	}
 	http.HandleFunc(fmt.Sprintf("/%s", snapshot), func(response http.ResponseWriter, request *http.Request) {
-		http.ServeFile(response, request, fmt.Sprintf("%s/%s", backupBaseDir, snapshot))
+		response.Header().Set(checksumHeader, sum)
+		http.ServeFile(response, request, fileLocation)
 	})
 	return httpServer.ListenAndServeTLS(certs["cert"], certs["key"])
 }
@@ -1115,49 +1423,42 @@ func setupTLSConfig(certs map[string]string, isServer bool) (*tls.Config, error)
 	return tlsConfig, nil
 }
 
-func IsRecurringSnapshot(name string) bool {
-	// name is fmt.Sprintf("%s-%s%s-", cluster.Name, typeFlag, providerFlag)
-	// typeFlag = "r": recurring
-	// typeFlag = "m": manual
-	//
-	// providerFlag = "l" local
-	// providerFlag = "s" s3
-	re := regexp.MustCompile("^c-[a-z0-9].*?-r.-")
-	return re.MatchString(name)
-}
-
-func downloadFromS3WithPrefix(client *minio.Client, prefix, bucket string) (string, error) {
+// downloadFromS3WithPrefix downloads the snapshot named prefix, compressed or not, to the backup directory. With stream,
+// a compressed snapshot is decompressed while downloading and the name of the decompressed snapshot is returned.
+func downloadFromS3WithPrefix(ctx context.Context, backend storageBackend, prefix string, stream bool) (string, error) {
 	var filename string
+	var found objectInfo
 
-	objectCh := client.ListObjects(context.TODO(), bucket, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: false,
-	})
-	for object := range objectCh {
-		if object.Err != nil {
-			log.Errorf("failed to list objects in backup buckets [%s]: %v", bucket, object.Err)
-			return "", object.Err
-		}
+	errFound := errors.New("found")
+	err := backend.List(prefix, false, func(object objectInfo) error {
 		decompressedFilename := decompressedName(object.Key)
 		log.Debugf("found key: [%s], decompressedFilename: [%s]", object.Key, decompressedFilename)
 		if prefix == decompressedFilename {
 			filename = object.Key
-			break
+			found = object
+			return errFound
 		}
 		decodedDecompressedFilename, err := url.QueryUnescape(decompressedFilename)
 		if err != nil {
 			log.Errorf("Unable to decode filename [%s]: %v", decompressedFilename, err)
-			continue
+			return nil
 		}
 		if prefix == decodedDecompressedFilename {
 			decodedObjectKey, err := url.QueryUnescape(object.Key)
 			if err != nil {
 				log.Errorf("Unable to decode object.Key [%s]: %v", object.Key, err)
-				continue
+				return nil
 			}
 			filename = decodedObjectKey
-			break
+			found = object
+			found.Key = decodedObjectKey
+			return errFound
 		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		log.Errorf("failed to list objects in backup target: %v", err)
+		return "", err
 	}
 	if len(filename) == 0 {
 		return "", fmt.Errorf("failed to download s3 backup: no backups found")
@@ -1165,33 +1466,19 @@ func downloadFromS3WithPrefix(client *minio.Client, prefix, bucket string) (stri
 	// if folder is included, strip it so it doesn't end up in a folder on the host itself
 	targetFilename := path.Base(filename)
 	targetFileLocation := fmt.Sprintf("%s/%s", backupBaseDir, targetFilename)
-	var object *minio.Object
-	var err error
 
-	for retries := 0; retries <= defaultS3Retries; retries++ {
-		object, err = client.GetObject(context.TODO(), bucket, filename, minio.GetObjectOptions{})
-		if err != nil {
-			log.Infof("Failed to download etcd snapshot file [%s]: %v, retried %d times", filename, err, retries)
-			if retries >= defaultS3Retries {
-				return "", fmt.Errorf("Unable to download backup file for [%s]: %v", filename, err)
-			}
+	if stream && isCompressed(targetFilename) {
+		snapshotFileLocation := fmt.Sprintf("%s/%s", backupBaseDir, decompressedName(targetFilename))
+		if err := streamDecompress(ctx, backend, found, snapshotFileLocation); err != nil {
+			return "", fmt.Errorf("Unable to download backup file for [%s]: %v", filename, err)
 		}
-		log.Infof("Successfully downloaded [%s]", filename)
-	}
-
-	localFile, err := os.Create(targetFileLocation)
-	if err != nil {
-		return "", fmt.Errorf("Failed to create local file [%s]: %v", targetFileLocation, err)
+		return decompressedName(targetFilename), nil
 	}
-	defer localFile.Close()
 
-	if _, err = io.Copy(localFile, object); err != nil {
-		return "", fmt.Errorf("Failed to copy retrieved object to local file [%s]: %v", targetFileLocation, err)
-	}
-	if err := os.Chmod(targetFileLocation, 0600); err != nil {
-		return "", fmt.Errorf("changing permission of the locally downloaded snapshot failed")
+	if err := downloadObject(ctx, backend, found, targetFileLocation); err != nil {
+		return "", fmt.Errorf("Unable to download backup file for [%s]: %v", filename, err)
 	}
-
+	log.Infof("Successfully downloaded [%s]", filename)
 	return targetFilename, nil
 }
 
@@ -1204,14 +1491,21 @@ func compressFiles(destinationFile string, fileNames []string) (string, error) {
 	}
 	defer zipFile.Close()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
+	// The checksum is computed while writing, so the archive doesn't have to be read again before uploading
+	h := sha256.New()
+	zipWriter := zip.NewWriter(io.MultiWriter(zipFile, h))
 	for _, file := range fileNames {
 		if err = AddFileToZip(zipWriter, file); err != nil {
+			zipWriter.Close()
 			return "", err
 		}
 	}
+	if err = zipWriter.Close(); err != nil {
+		return "", err
+	}
+	if err = writeChecksum(compressedFile, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return "", err
+	}
 	return compressedFile, nil
 }
 
@@ -1297,11 +1591,13 @@ func setTransportCA(tr http.RoundTripper, endpointCA string) (http.RoundTripper,
 	certPool := x509.NewCertPool()
 	certPool.AppendCertsFromPEM(ca)
 
-	tr.(*http.Transport).TLSClientConfig = &tls.Config{
+	// Clone the transport so a CA for one endpoint doesn't end up in the shared default transport
+	transport := tr.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
 		RootCAs: certPool,
 	}
 
-	return tr, nil
+	return transport, nil
 }
 
 func isCompressed(filename string) bool {
@@ -1347,41 +1643,40 @@ func AddFileToZip(zipWriter *zip.Writer, filename string) error {
 	return err
 }
 
-func retrieveAndWriteStatefile(backupName string) error {
+func retrieveAndWriteStatefile(ctx context.Context, backupName string) error {
 	log.WithFields(log.Fields{
 		"name": backupName,
 	}).Debug("retrieveAndWriteStatefile called")
 
 	var out bytes.Buffer
 	var err error
-	for retries := 0; retries <= defaultBackupRetries; retries++ {
+	err = retry(ctx, kubectlOperation, defaultBackupRetries, func(attempt uint) error {
 		log.WithFields(log.Fields{
-			"attempt": retries + 1,
+			"attempt": attempt + 1,
 			"name":    backupName,
 		}).Info("Trying to retrieve secret full-cluster-state using kubectl")
 
-		if retries > 0 {
-			time.Sleep(failureInterval)
-		}
-
 		// Try to retrieve cluster state to include in snapshot
-		cmd := exec.Command("/usr/local/bin/kubectl", "--request-timeout=30s", "--kubeconfig", "/etc/kubernetes/ssl/kubecfg-kube-node.yaml", "-n", "kube-system", "get", "secret", "full-cluster-state", "-o", "json")
 		var stderr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &stderr
-		err = cmd.Run()
+		out.Reset()
+		err = withTimeout(ctx, kubectlOperation, timeouts.Kubectl, func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, "/usr/local/bin/kubectl", "--request-timeout=30s", "--kubeconfig", "/etc/kubernetes/ssl/kubecfg-kube-node.yaml", "-n", "kube-system", "get", "secret", "full-cluster-state", "-o", "json")
+			cmd.Stdout = &out
+			cmd.Stderr = &stderr
+			return cmd.Run()
+		})
 		if err != nil {
 			log.WithFields(log.Fields{
-				"attempt": retries + 1,
+				"attempt": attempt + 1,
 				"name":    backupName,
 				"err":     fmt.Sprintf("%s: %s", err, stderr.String()),
 			}).Warn("Failed to retrieve secret full-cluster-state using kubectl")
-			if retries >= defaultBackupRetries {
-				return fmt.Errorf("Failed to retrieve secret full-cluster-state using kubectl: %v", fmt.Sprintf("%s: %s", err, stderr.String()))
-			}
-			continue
+			return fmt.Errorf("%w: %s", err, stderr.String())
 		}
-		break
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve secret full-cluster-state using kubectl: %v", err)
 	}
 	var m map[string]interface{}
 	err = json.Unmarshal(out.Bytes(), &m)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const metricsNamespace = "rke_etcd_backup"
+
+var metricsAddressFlag = cli.StringFlag{
+	Name:   "metrics-address",
+	Usage:  "Serve prometheus metrics on this address, like :9100",
+	EnvVar: "METRICS_ADDRESS",
+}
+
+var (
+	sizeBudgetBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "size_budget_bytes",
+		Help:      "Maximum size of the snapshots in a location, 0 if there is no budget",
+	}, []string{"location"})
+	snapshotsBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshots_bytes",
+		Help:      "Size of the snapshots kept in a location after the last retention run",
+	}, []string{"location"})
+	snapshotsKept = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshots",
+		Help:      "Number of snapshots kept in a location after the last retention run",
+	}, []string{"location"})
+	sizeBudgetEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "size_budget_evictions_total",
+		Help:      "Number of snapshots removed from a location to stay within its size budget",
+	}, []string{"location"})
+	uploadQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_queue_depth",
+		Help:      "Number of snapshots waiting to be uploaded to a storage target",
+	}, []string{"target"})
+	uploadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_failures_total",
+		Help:      "Number of failed attempts to upload a snapshot to a storage target",
+	}, []string{"target"})
+	operationTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_timeouts_total",
+		Help:      "Number of external calls that didn't finish within their timeout, by kind of operation",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(sizeBudgetBytes, snapshotsBytes, snapshotsKept, sizeBudgetEvictions, uploadQueueDepth,
+		uploadFailures, operationTimeoutsTotal)
+}
+
+// serveMetrics exposes the metrics on address in the background, if set
+func serveMetrics(address string) {
+	if len(address) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Infof("Serving metrics on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Errorf("Failed to serve metrics on %s: %v", address, err)
+		}
+	}()
+}
+
+// recordRetention updates the metrics of location after the policy removed expired from snapshots
+func recordRetention(location string, p retentionPolicy, snapshots []*snapshot, expired []expiredSnapshot) {
+	if p.DryRun {
+		return
+	}
+	removed := map[*snapshot]bool{}
+	for _, s := range expired {
+		removed[s.snapshot] = true
+		if s.SizeBudget {
+			sizeBudgetEvictions.WithLabelValues(location).Inc()
+		}
+	}
+	var size int64
+	var kept int
+	for _, s := range snapshots {
+		if !removed[s] {
+			size += s.Size
+			kept++
+		}
+	}
+	sizeBudgetBytes.WithLabelValues(location).Set(float64(p.MaxBytes))
+	snapshotsBytes.WithLabelValues(location).Set(float64(size))
+	snapshotsKept.WithLabelValues(location).Set(float64(kept))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	objectLockLegalHoldHeader   = "X-Amz-Object-Lock-Legal-Hold"
+	objectLockRetainUntilHeader = "X-Amz-Object-Lock-Retain-Until-Date"
+	noObjectLockConfig          = "ObjectLockConfigurationNotFoundError"
+)
+
+var holdFlags = append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.StringFlag{
+		Name:  "name",
+		Usage: "snapshot name to place the legal hold on",
+	},
+	cli.BoolFlag{
+		Name:  "release",
+		Usage: "release the legal hold instead of placing it",
+	},
+}, s3Flags...)
+
+// setObjectLockPeriod validates the object lock mode and makes the lock last as long as the retention keeps
+// snapshots when no explicit period is configured. Keep counts keep snapshots for their longest window, a policy
+// with only a last count has no window and needs an explicit period.
+func setObjectLockPeriod(bc *backupConfig, retention retentionPolicy) error {
+	if len(bc.LockMode) == 0 {
+		return nil
+	}
+	if !minio.RetentionMode(strings.ToUpper(bc.LockMode)).IsValid() {
+		return fmt.Errorf("invalid s3-object-lock-mode [%s], must be governance or compliance", bc.LockMode)
+	}
+	if bc.LockPeriod == 0 {
+		bc.LockPeriod = retention.window()
+		if bc.LockPeriod == 0 {
+			return fmt.Errorf("s3-object-lock-period must be set for retention %s, which doesn't keep snapshots for a time interval", retention)
+		}
+	}
+	if bc.LockPeriod <= 0 {
+		return fmt.Errorf("s3-object-lock-period must be positive")
+	}
+	return nil
+}
+
+// LockReason reports a legal hold or an object lock retention that hasn't expired yet
+func (s *s3Backend) LockReason(key string) (string, error) {
+	if !s.objectLockEnabled() {
+		return "", nil
+	}
+	var info minio.ObjectInfo
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		info, err = s.client.StatObject(ctx, s.bc.BucketName, key, minio.StatObjectOptions{})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if minio.LegalHoldStatus(info.Metadata.Get(objectLockLegalHoldHeader)) == minio.LegalHoldEnabled {
+		return "legal hold", nil
+	}
+	if retainUntil := info.Metadata.Get(objectLockRetainUntilHeader); len(retainUntil) != 0 {
+		until, err := time.Parse(time.RFC3339, retainUntil)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse retain-until date [%s] of [%s]: %v", retainUntil, key, err)
+		}
+		if until.After(time.Now()) {
+			return fmt.Sprintf("retained until %s", until.Format(time.RFC3339)), nil
+		}
+	}
+	return "", nil
+}
+
+// objectLockEnabled reports if the bucket has object lock enabled, objects can't be locked otherwise. If an error
+// is detected, assume we aren't privy to that information and report it as enabled.
+func (s *s3Backend) objectLockEnabled() bool {
+	s.lockOnce.Do(func() {
+		err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			_, _, _, _, err := s.client.GetObjectLockConfig(ctx, s.bc.BucketName)
+			return err
+		})
+		s.lockEnabled = err == nil || minio.ToErrorResponse(err).Code != noObjectLockConfig
+	})
+	return s.lockEnabled
+}
+
+func HoldBackupAction(c *cli.Context) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	name := path.Base(c.String("name"))
+	if name == "." || name == "/" {
+		return fmt.Errorf("snapshot name is required")
+	}
+	status := minio.LegalHoldEnabled
+	if c.Bool("release") {
+		status = minio.LegalHoldDisabled
+	}
+
+	ctx := context.Background()
+	bc := newBackupConfig(c)
+	client, err := minioClientFromConfig(ctx, bc)
+	if err != nil {
+		return err
+	}
+
+	var held []string
+	for _, key := range []string{fmt.Sprintf("%s.%s", name, compressedExtension), name} {
+		if len(bc.Folder) != 0 {
+			key = fmt.Sprintf("%s/%s", bc.Folder, key)
+		}
+		err := withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			_, err := client.StatObject(ctx, bc.BucketName, key, minio.StatObjectOptions{})
+			return err
+		})
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				continue
+			}
+			return fmt.Errorf("failed to stat [%s] in bucket %s: %v", key, bc.BucketName, err)
+		}
+		err = withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			return client.PutObjectLegalHold(ctx, bc.BucketName, key, minio.PutObjectLegalHoldOptions{
+				Status: &status,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set legal hold %s on [%s]: %v", status, key, err)
+		}
+		log.WithFields(log.Fields{
+			"name":   key,
+			"status": status,
+		}).Info("Set legal hold on s3 backup")
+		held = append(held, key)
+	}
+	if len(held) == 0 {
+		return fmt.Errorf("snapshot [%s] not found in bucket %s", name, bc.BucketName)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetObjectLockPeriod(t *testing.T) {
+	const day = 24 * time.Hour
+	for _, tc := range []struct {
+		name      string
+		period    time.Duration
+		retention retentionPolicy
+		expected  time.Duration
+		err       bool
+	}{
+		{name: "retention period", retention: retentionPolicy{Period: 72 * time.Hour}, expected: 72 * time.Hour},
+		{name: "explicit period", period: time.Hour, retention: retentionPolicy{Period: 72 * time.Hour}, expected: time.Hour},
+		// The default --retention of 24h doesn't apply to keep counts
+		{name: "monthly", retention: retentionPolicy{Period: day, Last: 10, Daily: 7, Weekly: 4, Monthly: 12}, expected: 12 * 31 * day},
+		{name: "weekly", retention: retentionPolicy{Period: day, Hourly: 48, Weekly: 2}, expected: 14 * day},
+		{name: "last only", retention: retentionPolicy{Period: day, Last: 10}, err: true},
+		{name: "last only with explicit period", period: 30 * day, retention: retentionPolicy{Period: day, Last: 10}, expected: 30 * day},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bc := &backupConfig{LockMode: "governance", LockPeriod: tc.period}
+			err := setObjectLockPeriod(bc, tc.retention)
+			if tc.err {
+				if err == nil {
+					t.Errorf("setObjectLockPeriod set %s, expected an error", bc.LockPeriod)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setObjectLockPeriod: %v", err)
+			}
+			if bc.LockPeriod != tc.expected {
+				t.Errorf("lock period is %s, expected %s", bc.LockPeriod, tc.expected)
+			}
+		})
+	}
+}
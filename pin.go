@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	pinnedExtension = "pinned"
+	pinnedTag       = "rke-etcd-backup-pinned"
+)
+
+var pinFlags = append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.StringFlag{
+		Name:  "name",
+		Usage: "snapshot name to pin or unpin",
+	},
+	cli.BoolFlag{
+		Name:   "s3-backup",
+		Usage:  "Also pin or unpin the snapshot in the s3 target",
+		EnvVar: "S3_BACKUP",
+	},
+	storageTargetsFlag,
+	storageTargetFlag,
+}, s3Flags...)
+
+// expiringBackend is implemented by backends that can expire objects on their own, regardless of pins
+type expiringBackend interface {
+	// ExpiryRule returns the rule that expires key, or an empty string if there is none
+	ExpiryRule(key string) (string, error)
+}
+
+// pinningBackend is implemented by backends that can mark the objects themselves as pinned. Other backends get a
+// marker object next to the snapshot instead.
+type pinningBackend interface {
+	SetPinned(key string, pinned bool) error
+	Pinned(key string) (bool, error)
+}
+
+func PinBackupAction(c *cli.Context) error {
+	return setSnapshotPinned(c, true)
+}
+
+func UnpinBackupAction(c *cli.Context) error {
+	return setSnapshotPinned(c, false)
+}
+
+// setSnapshotPinned pins or unpins the snapshot in /backup, if it is there, and in the selected storage target
+func setSnapshotPinned(c *cli.Context, pinned bool) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	name := strings.TrimSuffix(path.Base(c.String("name")), fmt.Sprintf(".%s", compressedExtension))
+	if name == "." || name == "/" {
+		return fmt.Errorf("snapshot name is required")
+	}
+
+	var found bool
+	for _, file := range []string{fmt.Sprintf("%s.%s", name, compressedExtension), name} {
+		if _, err := os.Stat(fmt.Sprintf("%s/%s", backupBaseDir, file)); err == nil {
+			found = true
+		}
+	}
+	if found {
+		if err := setLocalPinned(name, pinned); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"name":   name,
+			"pinned": pinned,
+		}).Info("Updated pin of local backup")
+	}
+
+	if c.Bool("s3-backup") || len(c.String("storage-target")) != 0 {
+		bc, err := selectedStorageTarget(c)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		backend, err := newStorageBackend(ctx, bc)
+		if err != nil {
+			return err
+		}
+		defer closeStorageBackend(backend)
+
+		var keys []string
+		for _, file := range []string{fmt.Sprintf("%s.%s", name, compressedExtension), name} {
+			key := folderKey(bc, file)
+			if _, err := backend.Stat(key); err != nil {
+				if err == errObjectNotFound {
+					continue
+				}
+				return fmt.Errorf("failed to stat [%s]: %v", key, err)
+			}
+			keys = append(keys, key)
+		}
+		if eb, ok := backend.(expiringBackend); ok && pinned && len(keys) != 0 {
+			rule, err := eb.ExpiryRule(keys[0])
+			if err != nil {
+				return fmt.Errorf("failed to check the lifecycle rules of [%s]: %v", keys[0], err)
+			}
+			if len(rule) != 0 {
+				return fmt.Errorf("snapshot [%s] is expired by lifecycle rule %s regardless of pins, copy it out of the folder of the rule to keep it", name, rule)
+			}
+		}
+		if len(keys) != 0 {
+			if err := setRemotePinned(backend, folderKey(bc, name), keys, pinned); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"name":   name,
+				"target": bc.Name,
+				"pinned": pinned,
+			}).Info("Updated pin of remote backup")
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("snapshot [%s] not found", name)
+	}
+	return nil
+}
+
+func localPinnedMarker(name string) string {
+	return fmt.Sprintf("%s/%s.%s", backupBaseDir, name, pinnedExtension)
+}
+
+func setLocalPinned(name string, pinned bool) error {
+	marker := localPinnedMarker(name)
+	if !pinned {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(marker, nil, 0600)
+}
+
+// isLocalPinned reports whether the snapshot in /backup has a pin marker
+func isLocalPinned(name string) bool {
+	_, err := os.Stat(localPinnedMarker(name))
+	return err == nil
+}
+
+// setRemotePinned pins the objects in keys that make up the snapshot at snapshotKey (the key without extension)
+func setRemotePinned(backend storageBackend, snapshotKey string, keys []string, pinned bool) error {
+	if pb, ok := backend.(pinningBackend); ok {
+		for _, key := range keys {
+			if err := pb.SetPinned(key, pinned); err != nil {
+				return fmt.Errorf("failed to update pin of [%s]: %v", key, err)
+			}
+		}
+		return nil
+	}
+
+	marker := fmt.Sprintf("%s.%s", snapshotKey, pinnedExtension)
+	if !pinned {
+		return backend.Delete(marker)
+	}
+	f, err := os.CreateTemp("", "pinned")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return backend.Put(marker, f.Name())
+}
+
+// isRemotePinned reports whether any object of the snapshot is pinned. markers holds the pin markers found while
+// listing, for backends without pinningBackend.
+func isRemotePinned(backend storageBackend, s *snapshot, markers map[string]bool) (bool, error) {
+	pb, ok := backend.(pinningBackend)
+	if !ok {
+		snapshotKey := strings.TrimSuffix(s.Keys[0], fmt.Sprintf(".%s", compressedExtension))
+		return markers[fmt.Sprintf("%s.%s", snapshotKey, pinnedExtension)], nil
+	}
+	for _, key := range s.Keys {
+		pinned, err := pb.Pinned(key)
+		if err != nil || pinned {
+			return pinned, err
+		}
+	}
+	return false, nil
+}
+
+// withoutPinned removes the pinned snapshots, which are never touched by retention, and logs them. The pins are
+// checked concurrently.
+func withoutPinned(location string, snapshots []*snapshot, isPinned func(*snapshot) (bool, error)) []*snapshot {
+	results := map[*snapshot]bool{}
+	var mu sync.Mutex
+	forEachSnapshot(snapshots, func(s *snapshot) {
+		p, err := isPinned(s)
+		if err != nil {
+			// Keep the snapshot when in doubt
+			log.Errorf("Error detected while checking pin of [%s], skipping it: %v", s.Name, err)
+			p = true
+		}
+		mu.Lock()
+		results[s] = p
+		mu.Unlock()
+	})
+	var unpinned []*snapshot
+	var pinned []string
+	for _, s := range snapshots {
+		if results[s] {
+			pinned = append(pinned, s.Name)
+			continue
+		}
+		unpinned = append(unpinned, s)
+	}
+	if len(pinned) != 0 {
+		log.WithFields(log.Fields{
+			"location": location,
+			"pinned":   strings.Join(pinned, ", "),
+		}).Infof("Skipping %d pinned snapshots", len(pinned))
+	}
+	return unpinned
+}
+
+func (s *s3Backend) SetPinned(key string, pinned bool) error {
+	return withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		t, err := s.client.GetObjectTagging(ctx, s.bc.BucketName, key, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return err
+		}
+		if pinned {
+			if err := t.Set(pinnedTag, "true"); err != nil {
+				return err
+			}
+		} else {
+			t.Remove(pinnedTag)
+			if t.Count() == 0 {
+				return s.client.RemoveObjectTagging(ctx, s.bc.BucketName, key, minio.RemoveObjectTaggingOptions{})
+			}
+		}
+		return s.client.PutObjectTagging(ctx, s.bc.BucketName, key, t, minio.PutObjectTaggingOptions{})
+	})
+}
+
+func (s *s3Backend) Pinned(key string) (bool, error) {
+	var pinned bool
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		t, err := s.client.GetObjectTagging(ctx, s.bc.BucketName, key, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return err
+		}
+		pinned = t.ToMap()[pinnedTag] == "true"
+		return nil
+	})
+	return pinned, err
+}
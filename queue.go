@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// The queue is kept in /backup, the only directory that survives a restart of the container
+const uploadQueueFile = backupBaseDir + "/.upload-queue.json"
+
+var uploadQueueFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:   "upload-backoff",
+		Usage:  "Time to wait before retrying a failed upload, doubled after every further failure",
+		EnvVar: "UPLOAD_BACKOFF",
+		Value:  30 * time.Second,
+	},
+	cli.DurationFlag{
+		Name:   "upload-max-backoff",
+		Usage:  "Maximum time to wait before retrying a failed upload",
+		EnvVar: "UPLOAD_MAX_BACKOFF",
+		Value:  time.Hour,
+	},
+	cli.DurationFlag{
+		Name:   "upload-max-age",
+		Usage:  "Give up on uploading a snapshot this long after it was taken, so local retention applies to it again. 0 retries forever",
+		EnvVar: "UPLOAD_MAX_AGE",
+		Value:  24 * time.Hour,
+	},
+}
+
+// uploadEntry is a snapshot waiting to be uploaded to a storage target
+type uploadEntry struct {
+	Name        string    `json:"name"`
+	File        string    `json:"file"`
+	Target      string    `json:"target"`
+	Time        time.Time `json:"time"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	Expires     time.Time `json:"expires,omitempty"`
+}
+
+// expired reports whether the queue gave up on the entry at now
+func (e *uploadEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// uploadQueue uploads rolling snapshots in the background, so a slow or failing storage target doesn't delay the
+// next snapshot. Entries are persisted to a file, failed uploads are retried with exponential backoff, also after a
+// restart, until they are older than maxAge.
+type uploadQueue struct {
+	path       string
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxAge     time.Duration
+	wake       map[string]chan struct{}
+
+	mu          sync.Mutex
+	entries     []*uploadEntry
+	targets     map[string]*backupConfig
+	clusterID   string
+	clusterName string
+	// streamed holds the newest snapshot streamed to each target since the target was last drained
+	streamed map[string]*uploadEntry
+}
+
+// loadUploadQueue reads the queue persisted at path. Entries of targets that are no longer configured are dropped.
+func loadUploadQueue(path string, targets []*backupConfig, backoff, maxBackoff, maxAge time.Duration) (*uploadQueue, error) {
+	q := &uploadQueue{
+		path:       path,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		maxAge:     maxAge,
+		wake:       map[string]chan struct{}{},
+		targets:    map[string]*backupConfig{},
+		streamed:   map[string]*uploadEntry{},
+	}
+	for _, target := range targets {
+		q.targets[target.Name] = target
+		q.wake[target.Name] = make(chan struct{}, 1)
+	}
+	entries, err := readUploadQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, ok := q.targets[e.Target]; !ok {
+			log.WithFields(log.Fields{
+				"name":   e.Name,
+				"target": e.Target,
+			}).Warn("Dropping queued upload to unknown storage target")
+			continue
+		}
+		if e.Expires.IsZero() && maxAge > 0 {
+			e.Expires = e.Time.Add(maxAge)
+		}
+		q.entries = append(q.entries, e)
+	}
+	if len(q.entries) != 0 {
+		log.WithFields(log.Fields{
+			"depth": len(q.entries),
+		}).Info("Resuming queued uploads")
+	}
+	q.recordDepth()
+	return q, nil
+}
+
+// readUploadQueue reads the entries persisted at path, a missing file is an empty queue
+func readUploadQueue(path string) ([]*uploadEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read upload queue: %v", err)
+	}
+	var entries []*uploadEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse upload queue [%s]: %v", path, err)
+	}
+	return entries, nil
+}
+
+// queuedFiles returns the base names of the snapshot files that are still queued for upload in the queue persisted at
+// path. Entries the queue gave up on are left out.
+func queuedFiles(path string) (map[string]bool, error) {
+	entries, err := readUploadQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	queued := map[string]bool{}
+	now := time.Now()
+	for _, e := range entries {
+		if !e.expired(now) {
+			queued[filepath.Base(e.File)] = true
+		}
+	}
+	return queued, nil
+}
+
+// withoutQueued removes the snapshots that are still queued for upload, so retention doesn't remove them before they
+// reached every target, and logs them
+func withoutQueued(snapshots []*snapshot, queued map[string]bool) []*snapshot {
+	var unqueued []*snapshot
+	var skipped []string
+	for _, s := range snapshots {
+		isQueued := false
+		for _, key := range s.Keys {
+			if queued[filepath.Base(key)] {
+				isQueued = true
+				break
+			}
+		}
+		if isQueued {
+			skipped = append(skipped, s.Name)
+			continue
+		}
+		unqueued = append(unqueued, s)
+	}
+	if len(skipped) != 0 {
+		log.WithFields(log.Fields{
+			"queued": strings.Join(skipped, ", "),
+		}).Infof("Skipping %d snapshots waiting for upload", len(skipped))
+	}
+	return unqueued
+}
+
+// setClusterOwner records the cluster on the uploads, see setClusterOwner
+func (q *uploadQueue) setClusterOwner(clusterID, clusterName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clusterID = clusterID
+	q.clusterName = clusterName
+}
+
+// enqueue adds the snapshot for every target and wakes up the worker
+func (q *uploadQueue) enqueue(backupName, compressedFilePath string, backupTime time.Time) {
+	q.enqueueTargets(backupName, compressedFilePath, backupTime, sortedKeys(q.targets))
+}
+
+// enqueueTargets adds the snapshot for the named targets and wakes up the worker
+func (q *uploadQueue) enqueueTargets(backupName, compressedFilePath string, backupTime time.Time, targets []string) {
+	var expires time.Time
+	if q.maxAge > 0 {
+		expires = backupTime.Add(q.maxAge)
+	}
+	q.mu.Lock()
+	for _, name := range targets {
+		q.entries = append(q.entries, &uploadEntry{
+			Name:    backupName,
+			File:    compressedFilePath,
+			Target:  name,
+			Time:    backupTime,
+			Expires: expires,
+		})
+	}
+	q.saveLocked()
+	depth := len(q.entries)
+	q.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"name":  backupName,
+		"depth": depth,
+	}).Info("Queued snapshot for upload")
+	for _, name := range targets {
+		select {
+		case q.wake[name] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// streamedTargets records a snapshot streamed to the named targets outside of the queue and wakes up their workers,
+// so retention runs in the next batch like after a queued upload instead of delaying the next snapshot
+func (q *uploadQueue) streamedTargets(backupName string, backupTime time.Time, targets []string) {
+	q.mu.Lock()
+	for _, name := range targets {
+		if e := q.streamed[name]; e == nil || backupTime.After(e.Time) {
+			q.streamed[name] = &uploadEntry{Name: backupName, Target: name, Time: backupTime}
+		}
+	}
+	q.mu.Unlock()
+	for _, name := range targets {
+		select {
+		case q.wake[name] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeStreamed returns and forgets the newest snapshot streamed to target, or nil
+func (q *uploadQueue) takeStreamed(target string) *uploadEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := q.streamed[target]
+	delete(q.streamed, target)
+	return e
+}
+
+// run drains the queue forever. drained is called once the due entries of a target were tried, with the target and
+// the newest snapshot uploaded or streamed to it, if any. Retention lists the whole target, so it runs once per batch
+// instead of after every upload.
+func (q *uploadQueue) run(ctx context.Context, drained func(target *backupConfig, e *uploadEntry)) {
+	// Each target is drained on its own, so a slow target doesn't hold back the uploads to the others
+	var wg sync.WaitGroup
+	for _, name := range sortedKeys(q.targets) {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			q.runTarget(ctx, name, drained)
+		}(name)
+	}
+	wg.Wait()
+}
+
+// runTarget drains the entries of a target forever, oldest snapshot first
+func (q *uploadQueue) runTarget(ctx context.Context, target string, drained func(target *backupConfig, e *uploadEntry)) {
+	for {
+		due, wait := q.due(target, time.Now())
+		newest := q.takeStreamed(target)
+		if len(due) == 0 && newest == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-q.wake[target]:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		for _, e := range due {
+			if q.upload(ctx, e) && (newest == nil || e.Time.After(newest.Time)) {
+				newest = e
+			}
+		}
+		if newest != nil {
+			drained(q.target(target), newest)
+		}
+	}
+}
+
+// target returns a copy of the named target with the cluster owner set
+func (q *uploadQueue) target(name string) *backupConfig {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	target := *q.targets[name]
+	target.ClusterID = q.clusterID
+	target.ClusterName = q.clusterName
+	return &target
+}
+
+// due drops the expired entries of target and returns the ones to upload now, or the time until the next entry is due
+func (q *uploadQueue) due(target string, now time.Time) ([]*uploadEntry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due, entries []*uploadEntry
+	wait := time.Duration(1<<63 - 1)
+	for _, e := range q.entries {
+		if e.Target != target {
+			entries = append(entries, e)
+			continue
+		}
+		if e.expired(now) {
+			log.WithFields(log.Fields{
+				"name":     e.Name,
+				"target":   e.Target,
+				"attempts": e.Attempts,
+				"error":    e.LastError,
+			}).Error("Giving up on uploading snapshot to storage target, it is older than the upload max age")
+			continue
+		}
+		entries = append(entries, e)
+		if d := e.NextAttempt.Sub(now); d > 0 {
+			// Wake up to drop the entry if it expires before its next attempt
+			if !e.Expires.IsZero() && e.Expires.Before(e.NextAttempt) {
+				d = e.Expires.Sub(now)
+			}
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		due = append(due, e)
+	}
+	if len(entries) != len(q.entries) {
+		q.entries = entries
+		q.saveLocked()
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].Time.Before(due[j].Time)
+	})
+	return due, wait
+}
+
+// upload tries to upload e and reports whether it succeeded
+func (q *uploadQueue) upload(ctx context.Context, e *uploadEntry) bool {
+	target := q.target(e.Target)
+
+	if _, err := os.Stat(e.File); os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"name":   e.Name,
+			"target": e.Target,
+		}).Warn("Dropping queued upload, the snapshot was removed locally")
+		q.remove(e)
+		return false
+	}
+
+	// The queue retries with backoff, so a single attempt per entry
+	err := uploadSnapshot(ctx, e.Name, e.File, target, 0)
+	if err == nil {
+		q.remove(e)
+		return true
+	}
+
+	uploadFailures.WithLabelValues(e.Target).Inc()
+	q.mu.Lock()
+	e.Attempts++
+	e.LastError = err.Error()
+	backoff := q.backoff
+	for i := 1; i < e.Attempts && backoff < q.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.maxBackoff {
+		backoff = q.maxBackoff
+	}
+	e.NextAttempt = time.Now().Add(backoff)
+	q.saveLocked()
+	depth := len(q.entries)
+	q.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"name":     e.Name,
+		"target":   e.Target,
+		"attempts": e.Attempts,
+		"retry":    backoff,
+		"depth":    depth,
+		"error":    err,
+	}).Error("Failed to upload snapshot to storage target")
+	return false
+}
+
+func (q *uploadQueue) remove(e *uploadEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.entries {
+		if entry == e {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	q.saveLocked()
+}
+
+// saveLocked persists the queue and updates the depth metrics, q.mu must be held
+func (q *uploadQueue) saveLocked() {
+	q.recordDepth()
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		log.Errorf("Failed to encode upload queue: %v", err)
+		return
+	}
+	// Write to a temporary file first, so a crash doesn't leave a truncated queue behind
+	tmpPath := q.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Errorf("Failed to write upload queue [%s]: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		log.Errorf("Failed to write upload queue [%s]: %v", q.path, err)
+	}
+}
+
+func (q *uploadQueue) recordDepth() {
+	depth := map[string]int{}
+	for name := range q.targets {
+		depth[name] = 0
+	}
+	for _, e := range q.entries {
+		depth[e.Target]++
+	}
+	for name, n := range depth {
+		uploadQueueDepth.WithLabelValues(name).Set(float64(n))
+	}
+}
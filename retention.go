@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var retentionFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "local-retention",
+		Usage:  "Retention for snapshots on this node, a time interval like 12h or keep counts like last=10,daily=7",
+		EnvVar: "LOCAL_RETENTION",
+	},
+	cli.StringFlag{
+		Name:   "local-max-bytes",
+		Usage:  "Size budget for snapshots on this node, like 20GiB. The oldest snapshots are removed when it is exceeded",
+		EnvVar: "LOCAL_MAX_BYTES",
+	},
+	cli.StringFlag{
+		Name:   "s3-max-bytes",
+		Usage:  "Size budget for snapshots in the s3 target, like 500GiB",
+		EnvVar: "S3_MAX_BYTES",
+	},
+	cli.StringFlag{
+		Name:   "s3-retention",
+		Usage:  "Retention for snapshots in the s3 target, a time interval like 2160h or keep counts like daily=7,monthly=12",
+		EnvVar: "S3_RETENTION",
+	},
+	cli.IntFlag{
+		Name:   "min-keep",
+		Usage:  "Never remove the newest N snapshots of a location, regardless of the retention. An s3 lifecycle rule can't honor it, so lifecycle refuses an explicit value above 0",
+		EnvVar: "MIN_KEEP",
+		Value:  1,
+	},
+	cli.IntFlag{
+		Name:   "keep-last",
+		Usage:  "Keep the last N snapshots, replaces --retention together with the other keep flags",
+		EnvVar: "KEEP_LAST",
+	},
+	cli.IntFlag{
+		Name:   "keep-hourly",
+		Usage:  "Keep the newest snapshot of every hour for this many hours",
+		EnvVar: "KEEP_HOURLY",
+	},
+	cli.IntFlag{
+		Name:   "keep-daily",
+		Usage:  "Keep the newest snapshot of every day for this many days",
+		EnvVar: "KEEP_DAILY",
+	},
+	cli.IntFlag{
+		Name:   "keep-weekly",
+		Usage:  "Keep the newest snapshot of every week for this many weeks",
+		EnvVar: "KEEP_WEEKLY",
+	},
+	cli.IntFlag{
+		Name:   "keep-monthly",
+		Usage:  "Keep the newest snapshot of every month for this many months",
+		EnvVar: "KEEP_MONTHLY",
+	},
+}
+
+var pruneFlags = append(append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.DurationFlag{
+		Name:  "retention",
+		Usage: "Retain backups within this time interval in hours",
+		Value: 24 * time.Hour,
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Only log the snapshots that would be removed and why",
+	},
+	cli.StringFlag{
+		Name:  "name",
+		Usage: "Name of a named snapshot of the cluster, to also apply the retention to its named snapshots",
+	},
+	cli.BoolFlag{
+		Name:   "s3-backup",
+		Usage:  "Apply the retention to the s3 target configured by the s3 flags",
+		EnvVar: "S3_BACKUP",
+	},
+	storageTargetsFlag,
+	clusterNameFlag,
+	adoptUnownedFlag,
+	keepVersionsFlag,
+	clusterIDFlag,
+}, retentionFlags...), s3Flags...)
+
+// retentionPolicy decides which snapshots are expired. Without any keep count, snapshots older than Period are
+// expired. With keep counts, they replace Period in a grandfather-father-son scheme: the Last snapshots are kept,
+// and for each tier the newest snapshot of every hour, day, week or month within the tier's window.
+// The newest MinKeep snapshots are never expired, so a clock jump or a long run of failed backups can't remove
+// every snapshot. When the snapshots that are kept exceed MaxBytes, the oldest ones are expired until they fit.
+// With DryRun set, expired snapshots are logged instead of removed.
+type retentionPolicy struct {
+	Period   time.Duration
+	Last     int
+	Hourly   int
+	Daily    int
+	Weekly   int
+	Monthly  int
+	MinKeep  int
+	MaxBytes int64
+	DryRun   bool
+}
+
+// snapshot is a single snapshot in a location, Keys holds its compressed and uncompressed variants
+type snapshot struct {
+	Name  string
+	Group string
+	Time  time.Time
+	Size  int64
+	Keys  []string
+}
+
+// expiredSnapshot is a snapshot the policy removes and why
+type expiredSnapshot struct {
+	*snapshot
+	Reason     string
+	SizeBudget bool
+}
+
+func newRetentionPolicy(c *cli.Context, period time.Duration) (retentionPolicy, error) {
+	p := retentionPolicy{
+		Period:  period,
+		Last:    c.Int("keep-last"),
+		Hourly:  c.Int("keep-hourly"),
+		Daily:   c.Int("keep-daily"),
+		Weekly:  c.Int("keep-weekly"),
+		Monthly: c.Int("keep-monthly"),
+		MinKeep: c.Int("min-keep"),
+	}
+	if p.Last < 0 || p.Hourly < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 || p.MinKeep < 0 {
+		return p, fmt.Errorf("keep counts can't be negative")
+	}
+	return p, nil
+}
+
+// parseRetentionPolicy overrides defaults with value, either a time interval (time semantics) or comma separated
+// keep counts like last=10,daily=7 (count semantics). An empty value returns defaults unchanged.
+func parseRetentionPolicy(value string, defaults retentionPolicy) (retentionPolicy, error) {
+	if len(value) == 0 {
+		return defaults, nil
+	}
+	p := retentionPolicy{
+		Period:   defaults.Period,
+		MinKeep:  defaults.MinKeep,
+		MaxBytes: defaults.MaxBytes,
+		DryRun:   defaults.DryRun,
+	}
+	if period, err := time.ParseDuration(value); err == nil {
+		if period <= 0 {
+			return p, fmt.Errorf("retention must be positive")
+		}
+		p.Period = period
+		return p, nil
+	}
+	counts := map[string]*int{
+		"last":    &p.Last,
+		"hourly":  &p.Hourly,
+		"daily":   &p.Daily,
+		"weekly":  &p.Weekly,
+		"monthly": &p.Monthly,
+	}
+	for _, field := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		count, found := counts[k]
+		if !ok || !found {
+			return p, fmt.Errorf("expected a time interval or keep counts like last=10,daily=7, got [%s]", value)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid count for %s: [%s]", k, v)
+		}
+		*count = n
+	}
+	if !p.tiered() {
+		return p, fmt.Errorf("at least one keep count must be set, got [%s]", value)
+	}
+	return p, nil
+}
+
+// localRetentionPolicy returns the policy for the snapshots on this node
+func localRetentionPolicy(c *cli.Context, defaults retentionPolicy) (retentionPolicy, error) {
+	p, err := parseRetentionPolicy(c.String("local-retention"), defaults)
+	if err != nil {
+		return p, fmt.Errorf("invalid local-retention: %v", err)
+	}
+	if p.MaxBytes, err = parseByteSize(c.String("local-max-bytes")); err != nil {
+		return p, fmt.Errorf("invalid local-max-bytes: %v", err)
+	}
+	return p, nil
+}
+
+// perSnapshot reports whether the policy decides on each snapshot on its own, without looking at the others
+func (p retentionPolicy) perSnapshot() bool {
+	return !p.tiered() && p.MaxBytes == 0
+}
+
+func (p retentionPolicy) tiered() bool {
+	return p.Last > 0 || p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+// window returns how long the policy keeps snapshots at most, the period or the window of the longest tier. Months are
+// counted as 31 days. A policy with only a last count has no window and returns 0.
+func (p retentionPolicy) window() time.Duration {
+	if !p.tiered() {
+		return p.Period
+	}
+	const day = 24 * time.Hour
+	var window time.Duration
+	for _, w := range []time.Duration{
+		time.Duration(p.Hourly) * time.Hour,
+		time.Duration(p.Daily) * day,
+		time.Duration(p.Weekly) * 7 * day,
+		time.Duration(p.Monthly) * 31 * day,
+	} {
+		if w > window {
+			window = w
+		}
+	}
+	return window
+}
+
+func (p retentionPolicy) String() string {
+	if !p.tiered() {
+		return p.Period.String()
+	}
+	var counts []string
+	for _, c := range []struct {
+		name  string
+		count int
+	}{{"last", p.Last}, {"hourly", p.Hourly}, {"daily", p.Daily}, {"weekly", p.Weekly}, {"monthly", p.Monthly}} {
+		if c.count > 0 {
+			counts = append(counts, fmt.Sprintf("%s=%d", c.name, c.count))
+		}
+	}
+	return strings.Join(counts, ",")
+}
+
+// expiredByGroup applies the policy to rolling snapshots and to the named snapshots of each cluster separately. The
+// size budget covers the whole location, so it is applied once to the snapshots kept in every group.
+func (p retentionPolicy) expiredByGroup(now time.Time, snapshots []*snapshot) []expiredSnapshot {
+	expired, _ := p.apply(now, snapshots)
+	return expired
+}
+
+// expiredWithout applies the policy to the snapshots filter lets through and returns them with the expired ones.
+// With keep counts or a size budget, every kept snapshot takes a slot or space from the others, so filter is called
+// for all of them before the policy is applied. A time based policy decides on each snapshot on its own, and filter,
+// which may send requests for each snapshot, is only called for the ones it expires and the newest MinKeep of each
+// group. When it leaves one of those out, the policy is applied again to check the ones taking its place.
+func (p retentionPolicy) expiredWithout(now time.Time, snapshots []*snapshot, filter func([]*snapshot) []*snapshot) ([]*snapshot, []expiredSnapshot) {
+	if !p.perSnapshot() {
+		snapshots = filter(snapshots)
+		expired, _ := p.apply(now, snapshots)
+		return snapshots, expired
+	}
+	checked := map[*snapshot]bool{}
+	for {
+		expired, newest := p.apply(now, snapshots)
+		var unchecked []*snapshot
+		for _, s := range snapshots {
+			if checked[s] || !newest[s] {
+				continue
+			}
+			unchecked = append(unchecked, s)
+		}
+		for _, s := range expired {
+			if !checked[s.snapshot] {
+				unchecked = append(unchecked, s.snapshot)
+			}
+		}
+		if len(unchecked) == 0 {
+			return snapshots, expired
+		}
+		filtered := map[*snapshot]bool{}
+		for _, s := range unchecked {
+			checked[s] = true
+			filtered[s] = true
+		}
+		for _, s := range filter(unchecked) {
+			filtered[s] = false
+		}
+		var remaining []*snapshot
+		for _, s := range snapshots {
+			if !filtered[s] {
+				remaining = append(remaining, s)
+			}
+		}
+		snapshots = remaining
+	}
+}
+
+// apply returns the expired snapshots and the newest MinKeep of each group
+func (p retentionPolicy) apply(now time.Time, snapshots []*snapshot) ([]expiredSnapshot, map[*snapshot]bool) {
+	var groups []string
+	byGroup := map[string][]*snapshot{}
+	for _, s := range snapshots {
+		if _, ok := byGroup[s.Group]; !ok {
+			groups = append(groups, s.Group)
+		}
+		byGroup[s.Group] = append(byGroup[s.Group], s)
+	}
+	keep := map[*snapshot]bool{}
+	newest := map[*snapshot]bool{}
+	for _, group := range groups {
+		p.keep(now, byGroup[group], keep, newest)
+	}
+
+	reason := fmt.Sprintf("not kept by retention policy %s", p)
+	if !p.tiered() {
+		reason = fmt.Sprintf("older than retention %s", p.Period)
+	}
+	evicted := p.evicted(snapshots, keep, newest)
+	var expired []expiredSnapshot
+	for _, s := range snapshots {
+		if evicted[s] {
+			expired = append(expired, expiredSnapshot{snapshot: s, Reason: fmt.Sprintf("exceeds size budget of %d bytes", p.MaxBytes), SizeBudget: true})
+		} else if !keep[s] {
+			expired = append(expired, expiredSnapshot{snapshot: s, Reason: reason})
+		}
+	}
+	return expired, newest
+}
+
+// keep marks the snapshots of a group that the policy keeps at now, and the newest MinKeep of them in newest
+func (p retentionPolicy) keep(now time.Time, snapshots []*snapshot, keep, newest map[*snapshot]bool) {
+	sorted := sortedByAge(snapshots)
+	if !p.tiered() {
+		cutoffTime := now.Add(p.Period * -1)
+		for _, s := range sorted {
+			if !s.Time.Before(cutoffTime) {
+				keep[s] = true
+			}
+		}
+	}
+	for i := 0; i < p.Last && i < len(sorted); i++ {
+		keep[sorted[i]] = true
+	}
+	tiers := []struct {
+		count  int
+		since  time.Time
+		bucket func(time.Time) string
+	}{
+		{p.Hourly, now.Add(time.Duration(-p.Hourly) * time.Hour), func(t time.Time) string { return t.UTC().Format("2006-01-02T15") }},
+		{p.Daily, now.AddDate(0, 0, -p.Daily), func(t time.Time) string { return t.UTC().Format("2006-01-02") }},
+		{p.Weekly, now.AddDate(0, 0, -7*p.Weekly), func(t time.Time) string {
+			year, week := t.UTC().ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{p.Monthly, now.AddDate(0, -p.Monthly, 0), func(t time.Time) string { return t.UTC().Format("2006-01") }},
+	}
+	for _, tier := range tiers {
+		if tier.count <= 0 {
+			continue
+		}
+		// The window also touches the partial hour, day, week or month at its start, so cap the buckets at count
+		seen := map[string]bool{}
+		for _, s := range sorted {
+			if s.Time.Before(tier.since) || len(seen) == tier.count {
+				break
+			}
+			if b := tier.bucket(s.Time); !seen[b] {
+				seen[b] = true
+				keep[s] = true
+			}
+		}
+	}
+	for i := 0; i < p.MinKeep && i < len(sorted); i++ {
+		newest[sorted[i]] = true
+		if !keep[sorted[i]] {
+			log.WithFields(log.Fields{
+				"name":     sorted[i].Name,
+				"min-keep": p.MinKeep,
+			}).Warn("Keeping snapshot past its retention as it is one of the newest snapshots")
+			keep[sorted[i]] = true
+		}
+	}
+}
+
+// evicted returns the oldest kept snapshots that have to go for the kept snapshots to fit MaxBytes. The newest
+// snapshots of each group are never evicted.
+func (p retentionPolicy) evicted(snapshots []*snapshot, keep, newest map[*snapshot]bool) map[*snapshot]bool {
+	evicted := map[*snapshot]bool{}
+	if p.MaxBytes <= 0 {
+		return evicted
+	}
+	sorted := sortedByAge(snapshots)
+	var size int64
+	for _, s := range sorted {
+		if keep[s] {
+			size += s.Size
+		}
+	}
+	for i := len(sorted) - 1; i >= 0 && size > p.MaxBytes; i-- {
+		if keep[sorted[i]] && !newest[sorted[i]] {
+			keep[sorted[i]] = false
+			evicted[sorted[i]] = true
+			size -= sorted[i].Size
+		}
+	}
+	if size > p.MaxBytes {
+		log.WithFields(log.Fields{
+			"size":     size,
+			"budget":   p.MaxBytes,
+			"min-keep": p.MinKeep,
+		}).Warn("Newest snapshots exceed the size budget")
+	}
+	return evicted
+}
+
+// sortedByAge returns a copy of snapshots, newest first
+func sortedByAge(snapshots []*snapshot) []*snapshot {
+	sorted := make([]*snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+	return sorted
+}
+
+// parseByteSize parses a size like 20GiB or 500000000, an empty value means no limit
+func parseByteSize(value string) (int64, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// logDryRun reports a snapshot that would be removed from location
+func logDryRun(location string, s expiredSnapshot) {
+	log.WithFields(log.Fields{
+		"location": location,
+		"name":     s.Name,
+		"files":    strings.Join(s.Keys, ", "),
+		"created":  s.Time.Format(time.RFC3339),
+		"reason":   s.Reason,
+	}).Info("Would delete snapshot")
+}
+
+// snapshotSet groups the compressed and uncompressed files of a snapshot, keeping the order they were added in
+type snapshotSet struct {
+	byName    map[string]*snapshot
+	snapshots []*snapshot
+}
+
+func newSnapshotSet() *snapshotSet {
+	return &snapshotSet{byName: map[string]*snapshot{}}
+}
+
+func (s *snapshotSet) add(n snapshotName, key string, size int64) {
+	if existing, ok := s.byName[n.Name]; ok {
+		existing.Keys = append(existing.Keys, key)
+		existing.Size += size
+		return
+	}
+	snap := &snapshot{Name: n.Name, Group: n.group(), Time: n.Time, Size: size, Keys: []string{key}}
+	s.byName[n.Name] = snap
+	s.snapshots = append(s.snapshots, snap)
+}
+
+// PruneAction applies the retention of save to every location, without taking a snapshot
+func PruneAction(c *cli.Context) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	retentionPeriod := c.Duration("retention")
+	if retentionPeriod == 0 {
+		return fmt.Errorf("retention is not set")
+	}
+	policy, err := newRetentionPolicy(c, retentionPeriod)
+	if err != nil {
+		return err
+	}
+	policy.DryRun = c.Bool("dry-run")
+	localPolicy, err := localRetentionPolicy(c, policy)
+	if err != nil {
+		return err
+	}
+	targets, err := storageTargets(c, policy)
+	if err != nil {
+		return err
+	}
+	setClusterOwner(targets, c.String("cluster-id"), c.String("cluster-name"))
+
+	ctx := context.Background()
+	now := time.Now()
+	DeleteBackups(now, localPolicy)
+	if prefix := getNamePrefix(c.String("name")); len(prefix) != 0 {
+		if err := DeleteNamedBackups(localPolicy, prefix); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets {
+		DeleteS3Backups(ctx, now, target.Retention, target)
+	}
+	return nil
+}
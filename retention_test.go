@@ -0,0 +1,312 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var retentionTestNow = mustParseTime("2024-03-15T12:00:00Z")
+
+func mustParseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// testSnapshots returns a rolling snapshot of size 1 for each timestamp
+func testSnapshots(timestamps ...string) []*snapshot {
+	var snapshots []*snapshot
+	for _, ts := range timestamps {
+		snapshots = append(snapshots, &snapshot{Name: ts, Time: mustParseTime(ts), Size: 1})
+	}
+	return snapshots
+}
+
+func expiredNames(expired []expiredSnapshot) []string {
+	var names []string
+	for _, s := range expired {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRetentionTiers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    retentionPolicy
+		snapshots []*snapshot
+		expired   []string
+	}{
+		{
+			name:      "period keeps the cutoff",
+			policy:    retentionPolicy{Period: 24 * time.Hour},
+			snapshots: testSnapshots("2024-03-15T11:00:00Z", "2024-03-14T12:00:00Z", "2024-03-14T11:59:59Z"),
+			expired:   []string{"2024-03-14T11:59:59Z"},
+		},
+		{
+			name:      "last",
+			policy:    retentionPolicy{Period: time.Hour, Last: 2},
+			snapshots: testSnapshots("2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z", "2024-03-03T00:00:00Z"),
+			expired:   []string{"2024-03-01T00:00:00Z"},
+		},
+		{
+			// The window starts at 09:00, the 09:30 snapshot would be a fourth hour
+			name:   "hourly",
+			policy: retentionPolicy{Hourly: 3},
+			snapshots: testSnapshots("2024-03-15T12:00:00Z", "2024-03-15T11:30:00Z", "2024-03-15T11:00:00Z",
+				"2024-03-15T10:30:00Z", "2024-03-15T10:00:00Z", "2024-03-15T09:30:00Z", "2024-03-15T08:30:00Z"),
+			expired: []string{"2024-03-15T08:30:00Z", "2024-03-15T09:30:00Z", "2024-03-15T10:00:00Z", "2024-03-15T11:00:00Z"},
+		},
+		{
+			name:   "daily",
+			policy: retentionPolicy{Daily: 3},
+			snapshots: testSnapshots("2024-03-15T11:00:00Z", "2024-03-15T01:00:00Z", "2024-03-14T20:00:00Z",
+				"2024-03-12T12:00:00Z", "2024-03-12T11:59:59Z"),
+			expired: []string{"2024-03-12T11:59:59Z", "2024-03-15T01:00:00Z"},
+		},
+		{
+			// ISO weeks start on monday, 2024-03-11 and 2024-03-04
+			name:   "weekly",
+			policy: retentionPolicy{Weekly: 2},
+			snapshots: testSnapshots("2024-03-15T10:00:00Z", "2024-03-11T01:00:00Z", "2024-03-10T23:00:00Z",
+				"2024-03-04T00:00:00Z", "2024-03-03T00:00:00Z"),
+			expired: []string{"2024-03-03T00:00:00Z", "2024-03-04T00:00:00Z", "2024-03-11T01:00:00Z"},
+		},
+		{
+			name:   "monthly",
+			policy: retentionPolicy{Monthly: 2},
+			snapshots: testSnapshots("2024-03-01T00:00:00Z", "2024-02-29T23:00:00Z", "2024-02-01T00:00:00Z",
+				"2024-01-31T00:00:00Z"),
+			expired: []string{"2024-01-31T00:00:00Z", "2024-02-01T00:00:00Z"},
+		},
+		{
+			name:   "tiers add up",
+			policy: retentionPolicy{Last: 1, Daily: 2, Monthly: 3},
+			snapshots: testSnapshots("2024-03-15T11:00:00Z", "2024-03-15T10:00:00Z", "2024-03-14T10:00:00Z",
+				"2024-03-14T09:00:00Z", "2024-02-20T00:00:00Z", "2024-02-10T00:00:00Z", "2024-01-20T00:00:00Z",
+				"2023-12-20T00:00:00Z"),
+			expired: []string{"2023-12-20T00:00:00Z", "2024-02-10T00:00:00Z", "2024-03-14T09:00:00Z", "2024-03-15T10:00:00Z"},
+		},
+		{
+			name:   "tiers per group",
+			policy: retentionPolicy{Last: 1},
+			snapshots: []*snapshot{
+				{Name: "rolling-new", Time: mustParseTime("2024-03-15T11:00:00Z")},
+				{Name: "rolling-old", Time: mustParseTime("2024-03-15T10:00:00Z")},
+				{Name: "named-new", Group: "c-abc12", Time: mustParseTime("2024-03-14T11:00:00Z")},
+				{Name: "named-old", Group: "c-abc12", Time: mustParseTime("2024-03-14T10:00:00Z")},
+			},
+			expired: []string{"named-old", "rolling-old"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expired := tc.policy.expiredByGroup(retentionTestNow, tc.snapshots)
+			if names := expiredNames(expired); !reflect.DeepEqual(names, tc.expired) {
+				t.Errorf("expired %v, expected %v", names, tc.expired)
+			}
+		})
+	}
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	defaults := retentionPolicy{Period: 24 * time.Hour, MinKeep: 1, MaxBytes: 100, DryRun: true}
+	for _, tc := range []struct {
+		value   string
+		policy  retentionPolicy
+		invalid bool
+	}{
+		{value: "", policy: defaults},
+		{value: "12h", policy: retentionPolicy{Period: 12 * time.Hour, MinKeep: 1, MaxBytes: 100, DryRun: true}},
+		{value: "last=10,daily=7", policy: retentionPolicy{Period: 24 * time.Hour, Last: 10, Daily: 7, MinKeep: 1, MaxBytes: 100, DryRun: true}},
+		{value: "hourly=24, weekly=4, monthly=12", policy: retentionPolicy{Period: 24 * time.Hour, Hourly: 24, Weekly: 4, Monthly: 12, MinKeep: 1, MaxBytes: 100, DryRun: true}},
+		{value: "0s", invalid: true},
+		{value: "-1h", invalid: true},
+		{value: "daily", invalid: true},
+		{value: "yearly=1", invalid: true},
+		{value: "daily=-1", invalid: true},
+		{value: "daily=seven", invalid: true},
+		{value: "last=0", invalid: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			p, err := parseRetentionPolicy(tc.value, defaults)
+			if tc.invalid {
+				if err == nil {
+					t.Errorf("parsed %+v, expected an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tc.policy {
+				t.Errorf("parsed %+v, expected %+v", p, tc.policy)
+			}
+		})
+	}
+}
+
+func TestRetentionMinKeep(t *testing.T) {
+	old := testSnapshots("2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z", "2024-03-03T00:00:00Z")
+	for _, tc := range []struct {
+		name      string
+		policy    retentionPolicy
+		snapshots []*snapshot
+		expired   []string
+	}{
+		{
+			name:      "everything expired",
+			policy:    retentionPolicy{Period: 24 * time.Hour, MinKeep: 2},
+			snapshots: old,
+			expired:   []string{"2024-03-01T00:00:00Z"},
+		},
+		{
+			name:      "no min-keep",
+			policy:    retentionPolicy{Period: 24 * time.Hour},
+			snapshots: old,
+			expired:   []string{"2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z", "2024-03-03T00:00:00Z"},
+		},
+		{
+			name:      "more than there are",
+			policy:    retentionPolicy{Period: 24 * time.Hour, MinKeep: 5},
+			snapshots: old,
+		},
+		{
+			name:      "outside every tier",
+			policy:    retentionPolicy{Hourly: 2, Daily: 1, MinKeep: 1},
+			snapshots: old,
+			expired:   []string{"2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z"},
+		},
+		{
+			name:   "per group",
+			policy: retentionPolicy{Period: 24 * time.Hour, MinKeep: 1},
+			snapshots: []*snapshot{
+				{Name: "rolling-new", Time: mustParseTime("2024-03-02T00:00:00Z")},
+				{Name: "rolling-old", Time: mustParseTime("2024-03-01T00:00:00Z")},
+				{Name: "named-new", Group: "c-abc12", Time: mustParseTime("2024-02-02T00:00:00Z")},
+				{Name: "named-old", Group: "c-abc12", Time: mustParseTime("2024-02-01T00:00:00Z")},
+			},
+			expired: []string{"named-old", "rolling-old"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expired := tc.policy.expiredByGroup(retentionTestNow, tc.snapshots)
+			if names := expiredNames(expired); !reflect.DeepEqual(names, tc.expired) {
+				t.Errorf("expired %v, expected %v", names, tc.expired)
+			}
+		})
+	}
+}
+
+// A snapshot the filter leaves out, like a pinned one, doesn't count towards min-keep
+func TestRetentionMinKeepWithout(t *testing.T) {
+	policy := retentionPolicy{Period: 24 * time.Hour, MinKeep: 1}
+	snapshots := testSnapshots("2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z", "2024-03-03T00:00:00Z")
+	var checked []string
+	remaining, expired := policy.expiredWithout(retentionTestNow, snapshots, func(unchecked []*snapshot) []*snapshot {
+		var kept []*snapshot
+		for _, s := range unchecked {
+			checked = append(checked, s.Name)
+			if s.Name != "2024-03-03T00:00:00Z" {
+				kept = append(kept, s)
+			}
+		}
+		return kept
+	})
+	if len(remaining) != 2 {
+		t.Errorf("%d snapshots remaining, expected 2", len(remaining))
+	}
+	if names, want := expiredNames(expired), []string{"2024-03-01T00:00:00Z"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expired %v, expected %v", names, want)
+	}
+	if len(checked) != len(snapshots) {
+		t.Errorf("checked %v, expected every snapshot once", checked)
+	}
+}
+
+// A snapshot the filter leaves out doesn't take a keep slot from the snapshots of this cluster, even when it isn't one
+// of the newest MinKeep
+func TestRetentionTiersWithout(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    retentionPolicy
+		snapshots []*snapshot
+		expired   []string
+	}{
+		{
+			name:      "last",
+			policy:    retentionPolicy{Last: 2, MinKeep: 1},
+			snapshots: testSnapshots("2024-03-15T11:00:00Z", "2024-03-15T10:00:00Z", "2024-03-15T09:00:00Z", "2024-03-15T07:00:00Z"),
+			expired:   []string{"2024-03-15T07:00:00Z"},
+		},
+		{
+			name:      "daily",
+			policy:    retentionPolicy{Daily: 3, MinKeep: 1},
+			snapshots: testSnapshots("2024-03-15T11:00:00Z", "2024-03-14T12:00:00Z", "2024-03-14T06:00:00Z", "2024-03-13T12:00:00Z", "2024-03-12T12:00:00Z"),
+			expired:   []string{"2024-03-12T12:00:00Z"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The second newest snapshot belongs to another cluster or is pinned
+			left := tc.snapshots[1]
+			remaining, expired := tc.policy.expiredWithout(retentionTestNow, tc.snapshots, func(candidates []*snapshot) []*snapshot {
+				var kept []*snapshot
+				for _, s := range candidates {
+					if s != left {
+						kept = append(kept, s)
+					}
+				}
+				return kept
+			})
+			if len(remaining) != len(tc.snapshots)-1 {
+				t.Errorf("%d snapshots remaining, expected %d", len(remaining), len(tc.snapshots)-1)
+			}
+			if names := expiredNames(expired); !reflect.DeepEqual(names, tc.expired) {
+				t.Errorf("expired %v, expected %v", names, tc.expired)
+			}
+		})
+	}
+}
+
+// The size budget covers every group of a location, but never evicts the newest snapshot of a group
+func TestRetentionMaxBytes(t *testing.T) {
+	snapshots := func() []*snapshot {
+		return []*snapshot{
+			{Name: "named-1130", Group: "c-abc12", Time: mustParseTime("2024-03-15T11:30:00Z"), Size: 10},
+			{Name: "rolling-1100", Time: mustParseTime("2024-03-15T11:00:00Z"), Size: 10},
+			{Name: "rolling-1000", Time: mustParseTime("2024-03-15T10:00:00Z"), Size: 10},
+			{Name: "rolling-0900", Time: mustParseTime("2024-03-15T09:00:00Z"), Size: 10},
+			{Name: "named-0800", Group: "c-abc12", Time: mustParseTime("2024-03-15T08:00:00Z"), Size: 10},
+			{Name: "rolling-expired", Time: mustParseTime("2024-03-14T00:00:00Z"), Size: 100},
+		}
+	}
+	for _, tc := range []struct {
+		name       string
+		maxBytes   int64
+		sizeBudget []string
+	}{
+		{name: "no budget"},
+		{name: "fits", maxBytes: 50},
+		{name: "oldest of the location", maxBytes: 30, sizeBudget: []string{"named-0800", "rolling-0900"}},
+		{name: "newest exceed the budget", maxBytes: 5, sizeBudget: []string{"named-0800", "rolling-0900", "rolling-1000"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := retentionPolicy{Period: 24 * time.Hour, MinKeep: 1, MaxBytes: tc.maxBytes}
+			var sizeBudget []expiredSnapshot
+			for _, s := range policy.expiredByGroup(retentionTestNow, snapshots()) {
+				if s.SizeBudget {
+					sizeBudget = append(sizeBudget, s)
+				} else if s.Name != "rolling-expired" {
+					t.Errorf("%s expired: %s", s.Name, s.Reason)
+				}
+			}
+			if names := expiredNames(sizeBudget); !reflect.DeepEqual(names, tc.sizeBudget) {
+				t.Errorf("size budget expired %v, expected %v", names, tc.sizeBudget)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"google.golang.org/api/googleapi"
+)
+
+// retryBackoffConfig is shared by every retried operation, the number of retries is set per kind of operation with
+// --backup-retries and --s3-retries
+type retryBackoffConfig struct {
+	// Initial is the wait after the first failure, doubled after every further failure up to Max
+	Initial time.Duration
+	Max     time.Duration
+	// MaxElapsed stops retrying once the waits between attempts would add up to more than this. The attempts don't
+	// count, they are limited by the operation timeouts, so a long upload that fails is still retried.
+	MaxElapsed time.Duration
+}
+
+var retryBackoff = retryBackoffConfig{
+	Initial:    failureInterval,
+	Max:        2 * time.Minute,
+	MaxElapsed: 15 * time.Minute,
+}
+
+var retryFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:        "retry-backoff",
+		Usage:       "Time to wait before retrying a failed etcd, kubectl or storage operation, doubled after every further failure",
+		EnvVar:      "RETRY_BACKOFF",
+		Value:       retryBackoff.Initial,
+		Destination: &retryBackoff.Initial,
+	},
+	cli.DurationFlag{
+		Name:        "retry-max-backoff",
+		Usage:       "Maximum time to wait before retrying a failed operation",
+		EnvVar:      "RETRY_MAX_BACKOFF",
+		Value:       retryBackoff.Max,
+		Destination: &retryBackoff.Max,
+	},
+	cli.DurationFlag{
+		Name:        "retry-max-elapsed",
+		Usage:       "Stop retrying a failed operation once the waits between attempts add up to this time, 0 to only limit the number of retries",
+		EnvVar:      "RETRY_MAX_ELAPSED",
+		Value:       retryBackoff.MaxElapsed,
+		Destination: &retryBackoff.MaxElapsed,
+	},
+}
+
+// permanentError marks an error that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// statusError is an unexpected HTTP response status
+type statusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.Status)
+}
+
+// retry calls fn until it succeeds, up to retries more times with exponential backoff and jitter in between. Errors
+// that retrying won't fix, see isRetryable, are returned right away.
+func retry(ctx context.Context, op string, retries uint, fn func(attempt uint) error) error {
+	var waited time.Duration
+	backoff := retryBackoff.Initial
+	for attempt := uint(0); ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		// Wait between half and the full backoff, so the nodes of a cluster don't retry in lockstep
+		wait := backoff
+		if wait > 0 {
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		}
+		if retryBackoff.MaxElapsed > 0 && waited+wait > retryBackoff.MaxElapsed {
+			return err
+		}
+		waited += wait
+		log.WithFields(log.Fields{
+			"operation": op,
+			"attempt":   attempt + 1,
+			"retry":     wait,
+			"error":     err,
+		}).Warn("Operation failed, retrying")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > retryBackoff.Max {
+			backoff = retryBackoff.Max
+		}
+	}
+}
+
+// isRetryable classifies err: network errors, timeouts, throttling and server errors are retried, errors about
+// credentials, permissions and missing buckets or files are not. Failed etcdctl and kubectl commands and unknown
+// errors are retried.
+func isRetryable(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if isTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if errors.Is(err, errObjectNotFound) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return true
+	}
+
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		switch resp.Code {
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoSuchBucket", "NoSuchKey",
+			"InvalidBucketName", "InvalidArgument":
+			return false
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable",
+			"Throttling", "ThrottlingException", "TooManyRequests":
+			return true
+		}
+		if resp.StatusCode != 0 {
+			return retryableStatus(resp.StatusCode)
+		}
+	}
+	var sErr *statusError
+	if errors.As(err, &sErr) {
+		return retryableStatus(sErr.StatusCode)
+	}
+	var azErr *azcore.ResponseError
+	if errors.As(err, &azErr) {
+		return retryableStatus(azErr.StatusCode)
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return retryableStatus(gErr.Code)
+	}
+	var sftpErr *sftp.StatusError
+	if errors.As(err, &sftpErr) {
+		switch sftpErr.FxCode() {
+		case sftp.ErrSSHFxPermissionDenied, sftp.ErrSSHFxNoSuchFile:
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
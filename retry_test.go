@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryMaxElapsed(t *testing.T) {
+	defer func(b retryBackoffConfig) { retryBackoff = b }(retryBackoff)
+	failed := errors.New("connection lost")
+
+	for _, tc := range []struct {
+		name       string
+		backoff    time.Duration
+		maxElapsed time.Duration
+		attempt    time.Duration
+		attempts   uint
+	}{
+		// An attempt that fails after running longer than MaxElapsed, like a large upload, is still retried
+		{name: "long attempt", backoff: time.Millisecond, maxElapsed: 20 * time.Millisecond, attempt: 50 * time.Millisecond, attempts: 3},
+		{name: "waits exceed max elapsed", backoff: 50 * time.Millisecond, maxElapsed: 20 * time.Millisecond, attempts: 1},
+		{name: "no limit", backoff: 30 * time.Millisecond, attempts: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			retryBackoff = retryBackoffConfig{Initial: tc.backoff, Max: tc.backoff, MaxElapsed: tc.maxElapsed}
+			var attempts uint
+			err := retry(context.Background(), uploadOperation, 2, func(uint) error {
+				attempts++
+				time.Sleep(tc.attempt)
+				return failed
+			})
+			if !errors.Is(err, failed) {
+				t.Errorf("retry returned %v, expected %v", err, failed)
+			}
+			if attempts != tc.attempts {
+				t.Errorf("retry made %d attempts, expected %d", attempts, tc.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryStopsOnPermanentErrors(t *testing.T) {
+	defer func(b retryBackoffConfig) { retryBackoff = b }(retryBackoff)
+	retryBackoff = retryBackoffConfig{Initial: time.Millisecond, Max: time.Millisecond}
+
+	var attempts uint
+	err := retry(context.Background(), uploadOperation, 3, func(uint) error {
+		attempts++
+		return permanent(errors.New("access denied"))
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("retry made %d attempts and returned %v, expected a single attempt", attempts, err)
+	}
+}
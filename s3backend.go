@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// maxDeleteBatch is the most objects a multi-object delete request takes
+const maxDeleteBatch = 1000
+
+// s3Backend stores snapshots in an s3 compatible bucket
+type s3Backend struct {
+	ctx    context.Context
+	client *minio.Client
+	bc     *backupConfig
+
+	lockOnce    sync.Once
+	lockEnabled bool
+}
+
+func (s *s3Backend) Put(key, filePath string) error {
+	opts := putObjectOptions(s.bc)
+	metadata, err := uploadMetadata(opts.UserMetadata, filePath)
+	if err != nil {
+		return err
+	}
+	opts.UserMetadata = metadata
+	// S3 rejects every request whose body doesn't match its MD5
+	opts.SendContentMd5 = true
+	return withTimeout(s.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		_, err := s.client.FPutObject(ctx, s.bc.BucketName, key, filePath, opts)
+		return err
+	})
+}
+
+// PutStream removes the checksum sidecar of a replaced snapshot first, as it doesn't match anymore
+func (s *s3Backend) PutStream(key string, r io.Reader) error {
+	if err := s.deleteChecksumSidecars([]string{key}); err != nil {
+		return err
+	}
+	opts := putObjectOptions(s.bc)
+	// Parts are buffered in memory, the default for streams of unknown size is over 500 MiB
+	opts.PartSize = streamPartSize
+	return withTimeout(s.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		_, err := s.client.PutObject(ctx, s.bc.BucketName, key, r, -1, opts)
+		return err
+	})
+}
+
+// SetChecksum stores the checksum of a streamed upload in a sidecar object next to it. The metadata of a multipart
+// upload is sent before its content, and copying the object onto itself to add it would store the snapshot twice in
+// versioned or locked buckets.
+func (s *s3Backend) SetChecksum(key, sum string) error {
+	data := checksumLine(sum, path.Base(key))
+	opts := putObjectOptions(s.bc)
+	opts.ContentType = "text/plain"
+	opts.SendContentMd5 = true
+	return withTimeout(s.ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		_, err := s.client.PutObject(ctx, s.bc.BucketName, sidecarKey(key, checksumExtension), bytes.NewReader(data), int64(len(data)), opts)
+		return err
+	})
+}
+
+// readChecksumSidecar returns the checksum in the sidecar of key, or an empty string if there is none
+func (s *s3Backend) readChecksumSidecar(key string) (string, error) {
+	var data []byte
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		object, err := s.client.GetObject(ctx, s.bc.BucketName, sidecarKey(key, checksumExtension), minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		data, err = io.ReadAll(io.LimitReader(object, 4096))
+		return err
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", nil
+		}
+		return "", err
+	}
+	return parseChecksumLine(data), nil
+}
+
+// deleteChecksumSidecars removes the checksum sidecars of keys. Only the ones that exist are removed, as removing a
+// missing object adds a delete marker in a versioned bucket.
+func (s *s3Backend) deleteChecksumSidecars(keys []string) error {
+	var sidecars []string
+	var mu sync.Mutex
+	var statErr error
+	forEachConcurrent(keys, func(key string) {
+		sidecar := sidecarKey(key, checksumExtension)
+		err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			_, err := s.client.StatObject(ctx, s.bc.BucketName, sidecar, minio.StatObjectOptions{})
+			return err
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			sidecars = append(sidecars, sidecar)
+		} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			statErr = err
+		}
+	})
+	if statErr != nil || len(sidecars) == 0 {
+		return statErr
+	}
+	for key, err := range s.deleteBatch(sidecars) {
+		if err != nil {
+			return fmt.Errorf("failed to delete [%s]: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *s3Backend) Get(key, filePath string) error {
+	return withTimeout(s.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		object, err := s.client.GetObject(ctx, s.bc.BucketName, key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		localFile, err := os.Create(filePath)
+		if err != nil {
+			return fmt.Errorf("Failed to create local file [%s]: %w", filePath, err)
+		}
+		defer localFile.Close()
+
+		if _, err = io.Copy(localFile, object); err != nil {
+			return fmt.Errorf("Failed to copy retrieved object to local file [%s]: %w", filePath, err)
+		}
+		return nil
+	})
+}
+
+func (s *s3Backend) GetRange(key string, offset int64, w io.Writer) error {
+	return withTimeout(s.ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+		opts := minio.GetObjectOptions{}
+		if offset > 0 {
+			if err := opts.SetRange(offset, 0); err != nil {
+				return err
+			}
+		}
+		object, err := s.client.GetObject(ctx, s.bc.BucketName, key, opts)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		_, err = io.Copy(w, object)
+		return err
+	})
+}
+
+// List applies the request timeout to each wait for the next object instead of the whole listing, so large buckets
+// with many pages and slow callbacks don't time out
+func (s *s3Backend) List(prefix string, recursive bool, fn func(objectInfo) error) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	objectCh := s.client.ListObjects(ctx, s.bc.BucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: recursive,
+	})
+	for {
+		object, ok, err := nextObject(ctx, objectCh)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if object.Err != nil {
+			return object.Err
+		}
+		// Non recursive listings include the common prefixes of sub folders
+		if strings.HasSuffix(object.Key, "/") || isSidecar(object.Key) {
+			continue
+		}
+		if err := fn(objectInfo{Key: object.Key, Size: object.Size, LastModified: object.LastModified, ETag: object.ETag}); err != nil {
+			return err
+		}
+	}
+}
+
+// nextObject waits for the next object of a listing with the request timeout. A wait covers at most one page request,
+// canceling the context of the listing on return ends the request.
+func nextObject(ctx context.Context, objectCh <-chan minio.ObjectInfo) (minio.ObjectInfo, bool, error) {
+	var object minio.ObjectInfo
+	var ok bool
+	err := withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		select {
+		case object, ok = <-objectCh:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return object, ok, err
+}
+
+// Delete removes the snapshot before its checksum sidecar
+func (s *s3Backend) Delete(key string) error {
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		return s.client.RemoveObject(ctx, s.bc.BucketName, key, minio.RemoveObjectOptions{})
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteChecksumSidecars([]string{key})
+}
+
+// DeleteBatch uses the multi-object delete API, keys are sent in batches of maxDeleteBatch with a timeout each. The
+// checksum sidecars of the removed keys are removed afterwards.
+func (s *s3Backend) DeleteBatch(keys []string) map[string]error {
+	errs := map[string]error{}
+	var deleted []string
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), maxDeleteBatch)]
+		keys = keys[len(batch):]
+		batchErrs := s.deleteBatch(batch)
+		for _, key := range batch {
+			if err, ok := batchErrs[key]; ok && err != nil {
+				errs[key] = err
+				continue
+			}
+			deleted = append(deleted, key)
+		}
+	}
+	var mu sync.Mutex
+	forEachConcurrent(deleted, func(key string) {
+		if err := s.deleteChecksumSidecars([]string{key}); err != nil {
+			mu.Lock()
+			errs[key] = err
+			mu.Unlock()
+		}
+	})
+	return errs
+}
+
+func (s *s3Backend) deleteBatch(keys []string) map[string]error {
+	errs := map[string]error{}
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		objectsCh := make(chan minio.ObjectInfo, len(keys))
+		for _, key := range keys {
+			objectsCh <- minio.ObjectInfo{Key: key}
+		}
+		close(objectsCh)
+		for rErr := range s.client.RemoveObjects(ctx, s.bc.BucketName, objectsCh, minio.RemoveObjectsOptions{}) {
+			errs[rErr.ObjectName] = rErr.Err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		// Objects whose result didn't arrive in time may or may not be removed
+		for _, key := range keys {
+			if _, ok := errs[key]; !ok {
+				errs[key] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (s *s3Backend) Stat(key string) (objectInfo, error) {
+	var info minio.ObjectInfo
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		info, err = s.client.StatObject(ctx, s.bc.BucketName, key, minio.StatObjectOptions{})
+		return err
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return objectInfo{}, errObjectNotFound
+		}
+		return objectInfo{}, err
+	}
+	metadata := normalizeMetadata(info.UserMetadata)
+	// Streamed uploads keep their checksum in a sidecar
+	if _, ok := metadata[checksumMetadata]; !ok {
+		sum, err := s.readChecksumSidecar(key)
+		if err != nil {
+			return objectInfo{}, fmt.Errorf("failed to read checksum of [%s]: %v", key, err)
+		}
+		if len(sum) != 0 {
+			metadata[checksumMetadata] = sum
+		}
+	}
+	return objectInfo{Key: info.Key, Size: info.Size, LastModified: info.LastModified, ETag: info.ETag, Metadata: metadata}, nil
+}
+
+func (s *s3Backend) VerifiesUploads() bool {
+	return true
+}
+
+// Versioned reports if versioning is enabled on the bucket. If an error is detected, assume we aren't privy
+// to that information and report the bucket as versioned.
+func (s *s3Backend) Versioned() bool {
+	var versioning minio.BucketVersioningConfiguration
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		var err error
+		versioning, err = s.client.GetBucketVersioning(ctx, s.bc.BucketName)
+		return err
+	})
+	if err != nil {
+		return true
+	}
+	return versioning.Enabled()
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpStorageType = "sftp"
+	defaultSFTPPort = "22"
+)
+
+// sftpBackend stores snapshots on an SFTP server, below Path in the same folder layout as in s3. Files can't carry
+// metadata, so the cluster owning a snapshot is kept in a hidden sidecar next to it.
+type sftpBackend struct {
+	ctx    context.Context
+	bc     *backupConfig
+	addr   string
+	config *ssh.ClientConfig
+	root   string
+
+	// mu guards the connection, which is replaced once it was closed
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+	closed *atomic.Bool
+}
+
+// newSFTPBackend connects with key based authentication. The host key must be listed in KnownHosts.
+func newSFTPBackend(ctx context.Context, bc *backupConfig) (*sftpBackend, error) {
+	log.WithFields(log.Fields{
+		"endpoint": bc.Endpoint,
+		"user":     bc.User,
+		"path":     bc.Path,
+		"folder":   bc.Folder,
+	}).Info("invoking set sftp client")
+
+	if len(bc.Endpoint) == 0 || len(bc.User) == 0 {
+		return nil, fmt.Errorf("endpoint and user are required for an sftp storage target")
+	}
+	if len(bc.PrivateKey) == 0 || len(bc.KnownHosts) == 0 {
+		return nil, fmt.Errorf("privateKey and knownHosts are required for an sftp storage target")
+	}
+	key, err := readFileOrBase64(bc.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sftp private key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sftp private key: %v", err)
+	}
+	hostKeyCallback, err := knownHostsCallback(bc.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := bc.Endpoint
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultSFTPPort)
+	}
+	s := &sftpBackend{
+		ctx:  ctx,
+		bc:   bc,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            bc.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         timeouts.Request,
+		},
+		root: ".",
+	}
+	if len(bc.Path) != 0 {
+		s.root = path.Clean(bc.Path)
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	fi, err := s.client.Stat(s.root)
+	if err != nil || !fi.IsDir() {
+		s.Close()
+		return nil, fmt.Errorf("sftp path %s is not a directory: %v", s.root, err)
+	}
+	return s, nil
+}
+
+// connect opens the connection and the sftp session, s.mu must be held once the backend is in use
+func (s *sftpBackend) connect() error {
+	conn, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return fmt.Errorf("failed to connect to sftp server %s: %v", s.addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start sftp session on %s: %v", s.addr, err)
+	}
+	closed := &atomic.Bool{}
+	go func() {
+		conn.Wait()
+		closed.Store(true)
+	}()
+	s.conn = conn
+	s.client = client
+	s.closed = closed
+	return nil
+}
+
+// knownHostsCallback verifies host keys against a known_hosts file, passed as a file path or a base64 string
+func knownHostsCallback(value string) (ssh.HostKeyCallback, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return knownhosts.New(value)
+	}
+	// knownhosts only reads files
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return knownhosts.New(f.Name())
+}
+
+func (s *sftpBackend) path(key string) string {
+	return path.Join(s.root, path.Clean("/"+key))
+}
+
+// Put writes to a temporary name and renames it once complete, so a partially written snapshot is never listed. The
+// checksum sidecar is written once the snapshot is in place.
+func (s *sftpBackend) Put(key, filePath string) error {
+	sum, err := snapshotChecksum(filePath)
+	if err != nil {
+		return permanent(fmt.Errorf("failed to compute checksum of [%s]: %v", filePath, err))
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := s.PutStream(key, src); err != nil {
+		return err
+	}
+	return s.SetChecksum(key, sum)
+}
+
+// PutStream writes the owner sidecar before the snapshot, so retention never sees the snapshot without its owner. The
+// checksum sidecar of a replaced snapshot is removed first, as it doesn't match anymore.
+func (s *sftpBackend) PutStream(key string, src io.Reader) error {
+	owner, err := ownerSidecar(s.bc)
+	if err != nil {
+		return err
+	}
+	return s.do(uploadOperation, timeouts.Upload, func(client *sftp.Client) error {
+		if owner != nil {
+			if err := writeFile(client, s.path(sidecarKey(key, ownerExtension)), bytes.NewReader(owner)); err != nil {
+				return err
+			}
+		}
+		if err := client.Remove(s.path(sidecarKey(key, checksumExtension))); err != nil && !isNotExist(err) {
+			return err
+		}
+		if err := writeFile(client, s.path(key), src); err != nil {
+			// Don't leave the sidecar behind for a snapshot that never existed
+			if _, serr := client.Stat(s.path(key)); isNotExist(serr) {
+				client.Remove(s.path(sidecarKey(key, ownerExtension)))
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// SetChecksum writes the checksum sidecar of key
+func (s *sftpBackend) SetChecksum(key, sum string) error {
+	return s.do(uploadOperation, timeouts.Upload, func(client *sftp.Client) error {
+		return writeFile(client, s.path(sidecarKey(key, checksumExtension)), bytes.NewReader(checksumLine(sum, path.Base(key))))
+	})
+}
+
+// writeFile writes src to a temporary name next to dest and renames it
+func writeFile(client *sftp.Client, dest string, src io.Reader) error {
+	if err := client.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	// Every node uploads to the same key, so each upload needs its own temporary name
+	tmp, err := uniqueName(dest, "tmp")
+	if err != nil {
+		return err
+	}
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		client.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	if err := client.Chmod(tmp, 0600); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	// Plain SFTP rename fails if the destination exists, prefer the OpenSSH extension that replaces it atomically
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		if err := client.PosixRename(tmp, dest); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	return replace(client, tmp, dest)
+}
+
+// replace renames tmp to dest on servers without the posix-rename extension. An existing dest is moved to a unique
+// name first and only removed once tmp took its place, so the snapshot is never lost.
+func replace(client *sftp.Client, tmp, dest string) error {
+	var old string
+	if _, err := client.Stat(dest); err == nil {
+		if old, err = uniqueName(dest, "old"); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+		if err := client.Rename(dest, old); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+	}
+	if err := client.Rename(tmp, dest); err != nil {
+		client.Remove(tmp)
+		if len(old) != 0 {
+			if rerr := client.Rename(old, dest); rerr != nil {
+				log.Warnf("Failed to restore [%s] from [%s]: %v", dest, old, rerr)
+			}
+		}
+		return err
+	}
+	if len(old) != 0 {
+		client.Remove(old)
+	}
+	return nil
+}
+
+// uniqueName returns a hidden name next to dest that no other upload uses, hidden files are skipped by List
+func uniqueName(dest, suffix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(dest), fmt.Sprintf(".%s.%s.%s", path.Base(dest), hex.EncodeToString(b), suffix)), nil
+}
+
+func (s *sftpBackend) Get(key, filePath string) error {
+	return s.do(downloadOperation, timeouts.Download, func(client *sftp.Client) error {
+		src, err := client.Open(s.path(key))
+		if err != nil {
+			if isNotExist(err) {
+				return errObjectNotFound
+			}
+			return err
+		}
+		defer src.Close()
+
+		localFile, err := os.Create(filePath)
+		if err != nil {
+			return fmt.Errorf("Failed to create local file [%s]: %w", filePath, err)
+		}
+		defer localFile.Close()
+
+		if _, err = io.Copy(localFile, src); err != nil {
+			return fmt.Errorf("Failed to copy remote file to local file [%s]: %w", filePath, err)
+		}
+		return nil
+	})
+}
+
+func (s *sftpBackend) GetRange(key string, offset int64, w io.Writer) error {
+	return s.do(downloadOperation, timeouts.Download, func(client *sftp.Client) error {
+		src, err := client.Open(s.path(key))
+		if err != nil {
+			if isNotExist(err) {
+				return errObjectNotFound
+			}
+			return err
+		}
+		defer src.Close()
+
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, src)
+		return err
+	})
+}
+
+func (s *sftpBackend) List(prefix string, recursive bool, fn func(objectInfo) error) error {
+	return s.do(requestOperation, timeouts.Request, func(client *sftp.Client) error {
+		// Only walk the directory the prefix points into, the remainder of the prefix is matched on the names
+		dir := prefix
+		if !strings.HasSuffix(prefix, "/") {
+			dir = path.Dir(prefix)
+		}
+		walker := client.Walk(s.path(dir))
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if walker.Path() == s.path(dir) && isNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			fi := walker.Stat()
+			if fi.IsDir() {
+				if walker.Path() != s.path(dir) && !recursive {
+					walker.SkipDir()
+				}
+				continue
+			}
+			key := strings.TrimPrefix(walker.Path(), s.root+"/")
+			// Skip uploads in progress
+			if strings.HasPrefix(fi.Name(), ".") || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if err := fn(objectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the snapshot before its sidecars, so it is never left behind without its owner
+func (s *sftpBackend) Delete(key string) error {
+	return s.do(requestOperation, timeouts.Request, func(client *sftp.Client) error {
+		if err := client.Remove(s.path(key)); err != nil && !isNotExist(err) {
+			return err
+		}
+		for _, extension := range sidecarExtensions {
+			if err := client.Remove(s.path(sidecarKey(key, extension))); err != nil && !isNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sftpBackend) Stat(key string) (objectInfo, error) {
+	var fi os.FileInfo
+	metadata := map[string]string{}
+	err := s.do(requestOperation, timeouts.Request, func(client *sftp.Client) error {
+		var err error
+		fi, err = client.Stat(s.path(key))
+		if err != nil {
+			return err
+		}
+		err = readSidecar(client, s.path(sidecarKey(key, ownerExtension)), func(data []byte) error {
+			return readOwnerSidecar(data, metadata)
+		})
+		if err != nil {
+			return err
+		}
+		return readSidecar(client, s.path(sidecarKey(key, checksumExtension)), func(data []byte) error {
+			if sum := parseChecksumLine(data); len(sum) != 0 {
+				metadata[checksumMetadata] = sum
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		if isNotExist(err) {
+			return objectInfo{}, errObjectNotFound
+		}
+		return objectInfo{}, err
+	}
+	return objectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime(), Metadata: metadata}, nil
+}
+
+// readSidecar calls fn with the content of the sidecar at p, if it exists
+func readSidecar(client *sftp.Client, p string, fn func(data []byte) error) error {
+	f, err := client.Open(p)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+// do calls fn with the timeout of op. SFTP calls don't take a context, so the connection is closed to end a call that
+// doesn't finish in time. The next call, like a retry, opens a new connection.
+func (s *sftpBackend) do(op string, timeout time.Duration, fn func(client *sftp.Client) error) error {
+	s.mu.Lock()
+	if s.closed.Load() {
+		log.WithFields(log.Fields{
+			"endpoint": s.addr,
+		}).Info("Reconnecting to sftp server")
+		s.client.Close()
+		if err := s.connect(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	conn, client, closed := s.conn, s.client, s.closed
+	s.mu.Unlock()
+
+	return withTimeout(s.ctx, op, timeout, func(ctx context.Context) error {
+		stop := context.AfterFunc(ctx, func() {
+			closed.Store(true)
+			conn.Close()
+		})
+		defer stop()
+		return fn(client)
+	})
+}
+
+func (s *sftpBackend) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client.Close()
+	return s.conn.Close()
+}
+
+func isNotExist(err error) bool {
+	return err != nil && (os.IsNotExist(err) || errors.Is(err, fs.ErrNotExist))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer serves the local filesystem over SFTP on a random port and returns a target for root
+func startSFTPServer(t *testing.T, root string) *backupConfig {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, config)
+		}
+	}()
+
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &backupConfig{
+		Type:       sftpStorageType,
+		Endpoint:   addr,
+		User:       "backup",
+		Path:       root,
+		PrivateKey: keyPath,
+		KnownHosts: knownHostsPath,
+	}
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+func newTestSFTPBackend(t *testing.T) (*sftpBackend, string) {
+	t.Helper()
+	root := t.TempDir()
+	backend, err := newSFTPBackend(context.Background(), startSFTPServer(t, root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend, root
+}
+
+func TestSFTPBackend(t *testing.T) {
+	backend, root := newTestSFTPBackend(t)
+	local := filepath.Join(t.TempDir(), "snapshot.zip")
+	if err := os.WriteFile(local, []byte("snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "folder/2024-01-01T00:00:00Z_etcd.zip"
+	if err := backend.Put(key, local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := backend.Stat(key)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len("snapshot")) {
+		t.Errorf("Stat returned size %d, expected %d", info.Size, len("snapshot"))
+	}
+	sum, err := fileSHA256(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata[checksumMetadata] != sum {
+		t.Errorf("Stat returned checksum %q, expected %q", info.Metadata[checksumMetadata], sum)
+	}
+	if fi, err := os.Stat(filepath.Join(root, key)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("uploaded file has mode %v, expected 0600: %v", fi.Mode().Perm(), err)
+	}
+	if err := verifyUpload(backend, key, local); err != nil {
+		t.Errorf("verifyUpload: %v", err)
+	}
+	// The upload is read back, so a corrupted file of the same size is detected
+	if err := os.WriteFile(filepath.Join(root, key), []byte("snapsh0t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyUpload(backend, key, local); err == nil {
+		t.Error("verifyUpload of a corrupted upload succeeded")
+	}
+	if err := backend.Put(key, local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// A wrong stored checksum is detected as well
+	if err := backend.SetChecksum(key, strings.Repeat("0", 64)); err != nil {
+		t.Fatalf("SetChecksum: %v", err)
+	}
+	if err := verifyUpload(backend, key, local); err == nil {
+		t.Error("verifyUpload with a wrong stored checksum succeeded")
+	}
+	if err := backend.Put(key, local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var listed []string
+	err = backend.List("folder/", true, func(o objectInfo) error {
+		listed = append(listed, o.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(listed) != 1 || listed[0] != key {
+		t.Errorf("List returned %v, expected [%s]", listed, key)
+	}
+
+	downloaded := filepath.Join(t.TempDir(), "downloaded.zip")
+	if err := backend.Get(key, downloaded); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if data, _ := os.ReadFile(downloaded); string(data) != "snapshot" {
+		t.Errorf("Get returned %q, expected %q", data, "snapshot")
+	}
+	if err := verifyDownload(backend, key, downloaded); err != nil {
+		t.Errorf("verifyDownload: %v", err)
+	}
+	// The download is checked against the checksum sidecar
+	if err := os.WriteFile(downloaded, []byte("snapsh0t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDownload(backend, key, downloaded); err == nil {
+		t.Error("verifyDownload of a corrupted download succeeded")
+	}
+	if err := backend.Get(key, downloaded); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := backend.GetRange(key, 4, &buf); err != nil {
+		t.Fatalf("GetRange: %v", err)
+	}
+	if buf.String() != "shot" {
+		t.Errorf("GetRange returned %q, expected %q", buf.String(), "shot")
+	}
+
+	if err := backend.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := backend.Stat(key); err != errObjectNotFound {
+		t.Errorf("Stat after Delete returned %v, expected errObjectNotFound", err)
+	}
+	assertNoTempFiles(t, filepath.Join(root, "folder"))
+	if err := backend.Get(key, downloaded); err != errObjectNotFound {
+		t.Errorf("Get after Delete returned %v, expected errObjectNotFound", err)
+	}
+}
+
+// TestSFTPBackendConcurrentPut uploads to the same key like every etcd node does, which must leave one complete
+// upload and no temporary files behind
+func TestSFTPBackendConcurrentPut(t *testing.T) {
+	root := t.TempDir()
+	bc := startSFTPServer(t, root)
+	key := "2024-01-01T00:00:00Z_etcd.zip"
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			backend, err := newSFTPBackend(context.Background(), bc)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer backend.Close()
+			errs[i] = backend.PutStream(key, strings.NewReader(strings.Repeat(fmt.Sprint(i), 1<<20)))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("PutStream %d: %v", i, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<20 || strings.Count(string(data), string(data[:1])) != len(data) {
+		t.Errorf("uploads were mixed up, got %d bytes", len(data))
+	}
+	assertNoTempFiles(t, root)
+}
+
+// TestSFTPBackendReplace covers servers without the posix-rename extension
+func TestSFTPBackendReplace(t *testing.T) {
+	backend, root := newTestSFTPBackend(t)
+	dest := filepath.Join(root, "snapshot.zip")
+	for _, content := range []string{"first", "second"} {
+		tmp := filepath.Join(root, ".snapshot.zip.upload.tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := replace(backend.client, tmp, dest); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+		if data, _ := os.ReadFile(dest); string(data) != content {
+			t.Errorf("replaced file has %q, expected %q", data, content)
+		}
+	}
+	assertNoTempFiles(t, root)
+
+	// A failing rename keeps the existing snapshot
+	if err := replace(backend.client, filepath.Join(root, ".missing.tmp"), dest); err == nil {
+		t.Error("replace with a missing file succeeded")
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "second" {
+		t.Errorf("existing file has %q after a failed replace, expected %q", data, "second")
+	}
+	assertNoTempFiles(t, root)
+}
+
+func assertNoTempFiles(t *testing.T, root string) {
+	t.Helper()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file %s was left behind", e.Name())
+		}
+	}
+}
+
+// TestSFTPBackendReconnect checks that a call after a timeout, like a retry, gets a new connection
+func TestSFTPBackendReconnect(t *testing.T) {
+	backend, _ := newTestSFTPBackend(t)
+	err := backend.do(requestOperation, 10*time.Millisecond, func(client *sftp.Client) error {
+		time.Sleep(50 * time.Millisecond)
+		_, err := client.Stat(".")
+		return err
+	})
+	if !isTimeout(err) {
+		t.Fatalf("do returned %v, expected a timeout", err)
+	}
+	if _, err := backend.Stat("missing.zip"); err != errObjectNotFound {
+		t.Errorf("Stat after a timeout returned %v, expected errObjectNotFound", err)
+	}
+}
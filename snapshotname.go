@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	rollingSnapshotSuffix = "_etcd"
+
+	recurringSnapshotType = "r"
+	manualSnapshotType    = "m"
+
+	localSnapshotProvider = "l"
+	s3SnapshotProvider    = "s"
+)
+
+// Rancher names snapshots fmt.Sprintf("%s-%s%s-%s_%s", cluster.Name, typeFlag, providerFlag, random, timestamp)
+var namedSnapshotRegexp = regexp.MustCompile(fmt.Sprintf("^(c-[a-z0-9].*?)-([%s%s])([%s%s])-([^_]*)(?:_(.+))?$",
+	recurringSnapshotType, manualSnapshotType, localSnapshotProvider, s3SnapshotProvider))
+
+// snapshotName is a parsed snapshot file name. Rolling snapshots are named <RFC3339>_etcd, snapshots taken by
+// Rancher (named snapshots) c-xxxxx-<type><provider>-xxxxx_<RFC3339>. Both can have the compressed extension.
+type snapshotName struct {
+	// Name is the file name without the compressed extension
+	Name    string
+	Rolling bool
+	// Cluster, Type and Provider are only set for named snapshots
+	Cluster  string
+	Type     string
+	Provider string
+	// Time is the zero time for named snapshots without a timestamp
+	Time time.Time
+}
+
+func parseSnapshotName(fileName string) (snapshotName, error) {
+	if !isSnapshotFile(fileName) {
+		return snapshotName{}, fmt.Errorf("[%s] is not a snapshot file", fileName)
+	}
+	name := strings.TrimSuffix(fileName, fmt.Sprintf(".%s", compressedExtension))
+	if strings.HasSuffix(name, rollingSnapshotSuffix) {
+		t, err := time.Parse(time.RFC3339, strings.TrimSuffix(name, rollingSnapshotSuffix))
+		if err != nil {
+			return snapshotName{}, fmt.Errorf("invalid rolling snapshot name [%s]: %v", fileName, err)
+		}
+		return snapshotName{Name: name, Rolling: true, Time: t}, nil
+	}
+
+	m := namedSnapshotRegexp.FindStringSubmatch(name)
+	if len(m) == 0 {
+		return snapshotName{}, fmt.Errorf("[%s] is not a snapshot name", fileName)
+	}
+	n := snapshotName{Name: name, Cluster: m[1], Type: m[2], Provider: m[3]}
+	if len(m[5]) != 0 {
+		t, err := time.Parse(time.RFC3339, m[5])
+		if err != nil {
+			return snapshotName{}, fmt.Errorf("invalid named snapshot name [%s]: %v", fileName, err)
+		}
+		n.Time = t
+	}
+	return n, nil
+}
+
+// isSnapshotFile reports whether fileName can be a snapshot. Pin markers, partial downloads with their validators,
+// checksum files and other hidden files like the upload queue can otherwise pass for named snapshots without a
+// timestamp.
+func isSnapshotFile(fileName string) bool {
+	if strings.HasPrefix(path.Base(fileName), ".") {
+		return false
+	}
+	for _, ext := range []string{pinnedExtension, partialExtension, validatorExtension, checksumExtension} {
+		if strings.HasSuffix(fileName, fmt.Sprintf(".%s", ext)) {
+			return false
+		}
+	}
+	return true
+}
+
+// recurring reports whether retention applies to the snapshot, manual snapshots are only removed on request
+func (n snapshotName) recurring() bool {
+	return n.Rolling || n.Type == recurringSnapshotType
+}
+
+// group returns the name of the series the snapshot belongs to, retention is applied to each series on its own
+func (n snapshotName) group() string {
+	if n.Rolling {
+		return ""
+	}
+	return n.Cluster
+}
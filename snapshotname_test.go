@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseSnapshotName(t *testing.T) {
+	for _, tc := range []struct {
+		fileName  string
+		name      snapshotName
+		recurring bool
+		invalid   bool
+	}{
+		{
+			fileName:  "2024-03-15T12:00:00Z_etcd",
+			name:      snapshotName{Name: "2024-03-15T12:00:00Z_etcd", Rolling: true, Time: mustParseTime("2024-03-15T12:00:00Z")},
+			recurring: true,
+		},
+		{
+			fileName:  "2024-03-15T12:00:00+02:00_etcd.zip",
+			name:      snapshotName{Name: "2024-03-15T12:00:00+02:00_etcd", Rolling: true, Time: mustParseTime("2024-03-15T10:00:00Z")},
+			recurring: true,
+		},
+		{
+			fileName:  "c-abc12-rl-xyz12_2024-03-15T12:00:00Z",
+			name:      snapshotName{Name: "c-abc12-rl-xyz12_2024-03-15T12:00:00Z", Cluster: "c-abc12", Type: "r", Provider: "l", Time: mustParseTime("2024-03-15T12:00:00Z")},
+			recurring: true,
+		},
+		{
+			fileName: "c-abc12-ms-xyz12_2024-03-15T12:00:00Z.zip",
+			name:     snapshotName{Name: "c-abc12-ms-xyz12_2024-03-15T12:00:00Z", Cluster: "c-abc12", Type: "m", Provider: "s", Time: mustParseTime("2024-03-15T12:00:00Z")},
+		},
+		{
+			fileName:  "c-abc12-rs-xyz12.zip",
+			name:      snapshotName{Name: "c-abc12-rs-xyz12", Cluster: "c-abc12", Type: "r", Provider: "s"},
+			recurring: true,
+		},
+		{fileName: "c-abc12-rl-xyz12.pinned", invalid: true},
+		{fileName: "2024-03-15T12:00:00Z_etcd.zip.pinned", invalid: true},
+		{fileName: "c-abc12-rl-xyz12.zip.part", invalid: true},
+		{fileName: "c-abc12-rl-xyz12.zip.part.validator", invalid: true},
+		{fileName: "c-abc12-rl-xyz12.zip.sha256", invalid: true},
+		{fileName: ".c-abc12-rl-xyz12.zip.sha256", invalid: true},
+		{fileName: ".c-abc12-rl-xyz12", invalid: true},
+		{fileName: ".upload-queue.json", invalid: true},
+		{fileName: "c-abc12-rl-xyz12_yesterday", invalid: true},
+		{fileName: "yesterday_etcd", invalid: true},
+		{fileName: "c-abc12-xl-xyz12", invalid: true},
+		{fileName: "cluster.rkestate", invalid: true},
+	} {
+		t.Run(tc.fileName, func(t *testing.T) {
+			n, err := parseSnapshotName(tc.fileName)
+			if tc.invalid {
+				if err == nil {
+					t.Errorf("parsed %+v, expected an error", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Name != tc.name.Name || n.Rolling != tc.name.Rolling || n.Cluster != tc.name.Cluster ||
+				n.Type != tc.name.Type || n.Provider != tc.name.Provider || !n.Time.Equal(tc.name.Time) {
+				t.Errorf("parsed %+v, expected %+v", n, tc.name)
+			}
+			if n.recurring() != tc.recurring {
+				t.Errorf("recurring is %t, expected %t", n.recurring(), tc.recurring)
+			}
+			if n.group() != n.Cluster {
+				t.Errorf("group is %q, expected %q", n.group(), n.Cluster)
+			}
+		})
+	}
+}
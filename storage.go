@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	s3StorageType         = "s3"
+	filesystemStorageType = "filesystem"
+	// deleteConcurrency bounds the requests in flight when removing or checking many objects
+	deleteConcurrency = 8
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// storageBackend is a location snapshots are uploaded to. Keys are slash separated and include the folder.
+type storageBackend interface {
+	// Put uploads the local file at filePath to key
+	Put(key, filePath string) error
+	// Get downloads key to the local file at filePath
+	Get(key, filePath string) error
+	// List calls fn for every object with a key starting with prefix. Unless recursive is set, objects in
+	// sub folders of the prefix are skipped.
+	List(prefix string, recursive bool, fn func(objectInfo) error) error
+	// Delete removes key
+	Delete(key string) error
+	// Stat returns the object stored at key or errObjectNotFound
+	Stat(key string) (objectInfo, error)
+}
+
+// versionedBackend is implemented by backends that can keep multiple versions of the same key
+type versionedBackend interface {
+	Versioned() bool
+}
+
+// batchDeleter is implemented by backends that can remove many objects per request
+type batchDeleter interface {
+	// DeleteBatch removes keys and returns the error of every key that couldn't be removed
+	DeleteBatch(keys []string) map[string]error
+}
+
+// rangeBackend is implemented by backends that can read an object from an offset, which allows resuming an
+// interrupted download and streaming it
+type rangeBackend interface {
+	// GetRange writes the object from offset on to w
+	GetRange(key string, offset int64, w io.Writer) error
+}
+
+// streamingBackend is implemented by backends that can upload a stream of unknown size
+type streamingBackend interface {
+	// PutStream uploads everything read from r to key, without checksum metadata as the checksum isn't known
+	// upfront
+	PutStream(key string, r io.Reader) error
+}
+
+// checksumBackend is implemented by backends that store checksum metadata, to add it to a streamed upload
+type checksumBackend interface {
+	// SetChecksum stores sum as the checksum of key, keeping its other metadata
+	SetChecksum(key, sum string) error
+}
+
+// verifyingBackend is implemented by backends whose storage service checks a checksum sent with every upload
+// request, so an upload that succeeded stored the bytes of the file
+type verifyingBackend interface {
+	VerifiesUploads() bool
+}
+
+// lockingBackend is implemented by backends that can prevent objects from being removed
+type lockingBackend interface {
+	// LockReason returns why key can't be removed, or an empty string if it can
+	LockReason(key string) (string, error)
+}
+
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// ETag identifies the version of the object, it is empty in filesystem and sftp targets
+	ETag string
+	// Metadata is only set by Stat, with lowercase names
+	Metadata map[string]string
+}
+
+var storageTargetFlag = cli.StringFlag{
+	Name:   "storage-target",
+	Usage:  "Name of the storage target in storage-targets to use instead of the s3 flags",
+	EnvVar: "STORAGE_TARGET",
+}
+
+// newStorageBackend returns the backend of the target. Its calls are bounded by the timeouts and end when ctx is done.
+func newStorageBackend(ctx context.Context, bc *backupConfig) (storageBackend, error) {
+	switch bc.Type {
+	case "", s3StorageType:
+		client, err := minioClientFromConfig(ctx, bc)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Backend{ctx: ctx, client: client, bc: bc}, nil
+	case filesystemStorageType:
+		return newFilesystemBackend(bc)
+	case azureStorageType:
+		return newAzureBackend(ctx, bc)
+	case gcsStorageType:
+		return newGCSBackend(ctx, bc)
+	case sftpStorageType:
+		return newSFTPBackend(ctx, bc)
+	default:
+		return nil, fmt.Errorf("unknown storage type [%s]", bc.Type)
+	}
+}
+
+// selectedStorageTarget returns the target named by storage-target, or the target configured by the s3 flags
+func selectedStorageTarget(c *cli.Context) (*backupConfig, error) {
+	name := c.String("storage-target")
+	if len(name) == 0 {
+		return newBackupConfig(c), nil
+	}
+	specs, err := readStorageTargets(c.String("storage-targets"))
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		if spec.Name == name {
+			bc, err := spec.backupConfig()
+			if err == nil && spec.KeepVersions == nil {
+				bc.KeepVersions = keepVersions(c)
+			}
+			if err == nil {
+				bc.AdoptUnowned = c.Bool("adopt-unowned")
+			}
+			return bc, err
+		}
+	}
+	return nil, fmt.Errorf("storage target [%s] not found in storage-targets", name)
+}
+
+// deleteKeys removes keys with a batch delete if the backend supports it, and otherwise with concurrent deletes.
+// It returns the error of every key that couldn't be removed.
+func deleteKeys(backend storageBackend, keys []string) map[string]error {
+	if bd, ok := backend.(batchDeleter); ok {
+		return bd.DeleteBatch(keys)
+	}
+	errs := map[string]error{}
+	var mu sync.Mutex
+	forEachConcurrent(keys, func(key string) {
+		if err := backend.Delete(key); err != nil {
+			mu.Lock()
+			errs[key] = err
+			mu.Unlock()
+		}
+	})
+	return errs
+}
+
+// forEachConcurrent calls fn for every key, with at most deleteConcurrency calls running at once
+func forEachConcurrent(keys []string, fn func(key string)) {
+	sem := make(chan struct{}, deleteConcurrency)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// forEachSnapshot calls fn for every snapshot with the same bounded concurrency as forEachConcurrent
+func forEachSnapshot(snapshots []*snapshot, fn func(s *snapshot)) {
+	byKey := make(map[string]*snapshot, len(snapshots))
+	keys := make([]string, 0, len(snapshots))
+	for _, s := range snapshots {
+		byKey[s.Keys[0]] = s
+		keys = append(keys, s.Keys[0])
+	}
+	forEachConcurrent(keys, func(key string) {
+		fn(byKey[key])
+	})
+}
+
+// folderKey prefixes name with the folder of the target, if any
+func folderKey(bc *backupConfig, name string) string {
+	if len(bc.Folder) != 0 {
+		return fmt.Sprintf("%s/%s", bc.Folder, name)
+	}
+	return name
+}
+
+// sidecarExtensions are the sidecars stored next to snapshots in backends without object metadata
+var sidecarExtensions = []string{ownerExtension, checksumExtension}
+
+// sidecarKey returns the hidden key next to key that holds what backends without object metadata store about it.
+// Hidden keys are skipped by List.
+func sidecarKey(key, extension string) string {
+	return path.Join(path.Dir(key), fmt.Sprintf(".%s.%s", path.Base(key), extension))
+}
+
+// isSidecar reports whether key is a sidecar of another key
+func isSidecar(key string) bool {
+	base := path.Base(key)
+	if !strings.HasPrefix(base, ".") {
+		return false
+	}
+	for _, extension := range sidecarExtensions {
+		if strings.HasSuffix(base, "."+extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeStorageBackend releases connections held by backends that keep them open, like sftp
+func closeStorageBackend(backend storageBackend) {
+	if c, ok := backend.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Debugf("failed to close storage backend: %v", err)
+		}
+	}
+}
+
+// readFileOrBase64 reads a value that is either a base64 string or a file path, like the s3-endpoint-ca. This
+// allows passing it through the rke/rancher api without writing it to the container filesystem.
+func readFileOrBase64(value string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err == nil {
+		return data, nil
+	}
+	return os.ReadFile(value)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// testStorageBackend runs the calls every backend has to support against backend, which must be empty. The metadata is
+// only checked if the backend returns any. bc is the target the backend was created for.
+func testStorageBackend(t *testing.T, backend storageBackend, bc *backupConfig) {
+	t.Helper()
+	content := []byte("snapshot")
+	local := filepath.Join(t.TempDir(), "2024-01-01T00:00:00Z_etcd.zip")
+	if err := os.WriteFile(local, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileSHA256(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "folder/2024-01-01T00:00:00Z_etcd.zip"
+	if err := backend.Put(key, local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := backend.Stat(key)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Stat returned size %d, expected %d", info.Size, len(content))
+	}
+	storesMetadata := info.Metadata != nil
+	if storesMetadata && info.Metadata[checksumMetadata] != sum {
+		t.Errorf("Stat returned checksum %q, expected %q", info.Metadata[checksumMetadata], sum)
+	}
+	if storesMetadata && info.Metadata[clusterIDMetadata] != bc.ClusterID {
+		t.Errorf("Stat returned cluster id %q, expected %q", info.Metadata[clusterIDMetadata], bc.ClusterID)
+	}
+	if err := verifyUpload(backend, key, local); storesMetadata && err != nil {
+		t.Errorf("verifyUpload: %v", err)
+	}
+
+	// Objects in sub folders are only listed recursively
+	if err := backend.Put("folder/sub/2024-01-02T00:00:00Z_etcd.zip", local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for _, recursive := range []bool{false, true} {
+		var listed []string
+		err := backend.List("folder/", recursive, func(o objectInfo) error {
+			listed = append(listed, o.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		expected := 1
+		if recursive {
+			expected = 2
+		}
+		if len(listed) != expected || listed[0] != key {
+			t.Errorf("List with recursive %t returned %v", recursive, listed)
+		}
+	}
+
+	downloaded := filepath.Join(t.TempDir(), "downloaded.zip")
+	if err := backend.Get(key, downloaded); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if data, _ := os.ReadFile(downloaded); !bytes.Equal(data, content) {
+		t.Errorf("Get returned %q, expected %q", data, content)
+	}
+	if err := verifyDownload(backend, key, downloaded); err != nil {
+		t.Errorf("verifyDownload: %v", err)
+	}
+	if rb, ok := backend.(rangeBackend); ok {
+		var buf bytes.Buffer
+		if err := rb.GetRange(key, 4, &buf); err != nil {
+			t.Fatalf("GetRange: %v", err)
+		}
+		if buf.String() != "shot" {
+			t.Errorf("GetRange returned %q, expected %q", buf.String(), "shot")
+		}
+	}
+
+	// Streamed uploads get their checksum afterwards
+	if sb, ok := backend.(streamingBackend); ok {
+		streamKey := "folder/2024-01-03T00:00:00Z_etcd.zip"
+		if err := sb.PutStream(streamKey, bytes.NewReader(content)); err != nil {
+			t.Fatalf("PutStream: %v", err)
+		}
+		if cb, ok := backend.(checksumBackend); ok {
+			if err := cb.SetChecksum(streamKey, sum); err != nil {
+				t.Fatalf("SetChecksum: %v", err)
+			}
+			info, err := backend.Stat(streamKey)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Size != int64(len(content)) {
+				t.Errorf("Stat of streamed upload returned size %d, expected %d", info.Size, len(content))
+			}
+			if storesMetadata && (info.Metadata[checksumMetadata] != sum || info.Metadata[clusterIDMetadata] != bc.ClusterID) {
+				t.Errorf("Stat of streamed upload returned metadata %v", info.Metadata)
+			}
+		}
+
+		// A failed upload must not leave a truncated snapshot behind
+		failedKey := "folder/2024-01-04T00:00:00Z_etcd.zip"
+		r := io.MultiReader(bytes.NewReader(content), iotest.ErrReader(errors.New("snapshot failed")))
+		if err := sb.PutStream(failedKey, r); err == nil {
+			t.Error("PutStream of a failing stream succeeded")
+		}
+		if _, err := backend.Stat(failedKey); err != errObjectNotFound {
+			t.Errorf("Stat after a failed PutStream returned %v, expected errObjectNotFound", err)
+		}
+	}
+
+	if err := backend.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := backend.Stat(key); err != errObjectNotFound {
+		t.Errorf("Stat after Delete returned %v, expected errObjectNotFound", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.zip")
+	if err := backend.Get(key, missing); err != errObjectNotFound {
+		t.Errorf("Get after Delete returned %v, expected errObjectNotFound", err)
+	}
+	// A later run would take the file for a local snapshot
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Get of a missing object left a file behind: %v", err)
+	}
+	// Removing a missing object is not an error, retention may race with another node
+	if err := backend.Delete(key); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// streamPartSize is the size of the parts of streamed uploads, which are buffered in memory
+const streamPartSize = 16 << 20
+
+var streamUploadFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:   "stream-upload",
+		Usage:  "Stream snapshots from etcd through compression straight to the storage targets, without staging them in /backup",
+		EnvVar: "STREAM_UPLOAD",
+	},
+	cli.BoolFlag{
+		Name:   "stream-local-copy",
+		Usage:  "With stream-upload, also write the compressed snapshot to /backup in the same pass",
+		EnvVar: "STREAM_LOCAL_COPY",
+	},
+}
+
+// dropWriter stops writing to w after its first error, so a failing destination doesn't stop the others
+type dropWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dropWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// countWriter counts the bytes written to it
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// streamBackup takes a snapshot like CreateBackup, but compresses it while it is read from etcd and uploads the
+// archive to every target in the same pass. With localCopy the archive is written to /backup as well, and its path is
+// returned. Failing to read the snapshot from etcd is retried, a failed upload isn't as the snapshot can't be read
+// again; the error of every target is returned.
+func streamBackup(ctx context.Context, backupName, etcdCACert, etcdCert, etcdKey, endpoints string, targets []*backupConfig,
+	clusterID, clusterName string, localCopy bool) (string, []error, error) {
+	errs := make([]error, len(targets))
+	backends := make([]storageBackend, len(targets))
+	for i, target := range targets {
+		// The targets are shared with the upload queue
+		bc := *target
+		bc.ClusterID = clusterID
+		bc.ClusterName = clusterName
+		backend, err := newStorageBackend(ctx, &bc)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer closeStorageBackend(backend)
+		if _, ok := backend.(streamingBackend); !ok {
+			errs[i] = fmt.Errorf("storage target doesn't support streaming uploads")
+			continue
+		}
+		backends[i] = backend
+	}
+
+	compressedFilePath := fmt.Sprintf("%s/%s.%s", backupBaseDir, backupName, compressedExtension)
+	partialPath := fmt.Sprintf("%s/.%s.%s", backupBaseDir, filepath.Base(compressedFilePath), partialExtension)
+	defer os.Remove(partialPath)
+
+	var result streamResult
+	err := retry(ctx, snapshotOperation, backupRetries, func(attempt uint) error {
+		if err := checkEtcdHealth(ctx, etcdCACert, etcdCert, etcdKey, endpoints); err != nil {
+			return err
+		}
+		var err error
+		result, err = streamBackupOnce(ctx, backupName, etcdCACert, etcdCert, etcdKey, endpoints, targets,
+			backends, localCopy, partialPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"attempt": attempt + 1,
+				"error":   err,
+			}).Warn("Backup failed")
+		}
+		return err
+	})
+	if err != nil {
+		return "", errs, err
+	}
+	for i := range targets {
+		if errs[i] == nil {
+			errs[i] = result.errs[i]
+		}
+		if errs[i] != nil {
+			uploadFailures.WithLabelValues(targets[i].Name).Inc()
+			log.WithFields(log.Fields{
+				"name":   backupName,
+				"target": targets[i].Name,
+				"error":  errs[i],
+			}).Error("Failed to upload snapshot to storage target")
+		}
+	}
+
+	stateFile := fmt.Sprintf("%s/%s.%s", k8sBaseDir, backupName, clusterStateExtension)
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Removing statefile failed")
+	}
+	if !localCopy {
+		return "", errs, nil
+	}
+	if result.localErr != nil {
+		log.WithFields(log.Fields{
+			"name":  backupName,
+			"error": result.localErr,
+		}).Error("Failed to write local copy of streamed snapshot")
+		return "", errs, nil
+	}
+	if err := os.Rename(partialPath, compressedFilePath); err != nil {
+		return "", errs, err
+	}
+	if err := writeChecksum(compressedFilePath, result.sum); err != nil {
+		return "", errs, err
+	}
+	return compressedFilePath, errs, nil
+}
+
+// streamRollingBackup streams a rolling snapshot to the targets and hands the ones it reached to the upload queue,
+// whose workers apply their retention off the snapshot path. The local copy, if any, is queued for upload to the
+// targets that failed.
+func streamRollingBackup(ctx context.Context, c *cli.Context, queue *uploadQueue, backupName string, backupTime time.Time,
+	targets []*backupConfig, clusterID string, localPolicy retentionPolicy) {
+	compressedFilePath, errs, err := streamBackup(ctx, backupName, c.String("cacert"), c.String("cert"), c.String("key"),
+		c.String("endpoints"), targets, clusterID, c.String("cluster-name"), c.Bool("stream-local-copy"))
+	if err != nil {
+		return
+	}
+	var uploaded, failed []string
+	for i, target := range targets {
+		if errs[i] != nil {
+			failed = append(failed, target.Name)
+			continue
+		}
+		uploaded = append(uploaded, target.Name)
+	}
+	queue.streamedTargets(backupName, backupTime, uploaded)
+	if len(compressedFilePath) == 0 {
+		return
+	}
+	if len(failed) != 0 {
+		queue.enqueueTargets(backupName, compressedFilePath, backupTime, failed)
+	}
+	DeleteBackups(backupTime, localPolicy)
+}
+
+// streamResult is the outcome of a pass that read the whole snapshot from etcd
+type streamResult struct {
+	// errs holds the upload error of every target
+	errs     []error
+	localErr error
+	// sum is the checksum of the archive
+	sum string
+}
+
+// streamBackupOnce makes a single pass, failing only if the snapshot couldn't be read from etcd
+func streamBackupOnce(ctx context.Context, backupName, etcdCACert, etcdCert, etcdKey, endpoints string,
+	targets []*backupConfig, backends []storageBackend, localCopy bool, partialPath string) (streamResult, error) {
+	var local *os.File
+	var localWriter *dropWriter
+	if localCopy {
+		var err error
+		if local, err = os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return streamResult{}, permanent(err)
+		}
+		defer local.Close()
+		localWriter = &dropWriter{w: local}
+	}
+
+	errs := make([]error, len(targets))
+	writers := make([]*dropWriter, len(targets))
+	pipes := make([]*io.PipeWriter, len(targets))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		if backend == nil {
+			continue
+		}
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		writers[i] = &dropWriter{w: pw}
+		wg.Add(1)
+		go func(i int, backend streamingBackend) {
+			defer wg.Done()
+			errs[i] = backend.PutStream(folderKey(targets[i], fmt.Sprintf("%s.%s", backupName, compressedExtension)), pr)
+			// Writes fail from now on, instead of blocking if the upload stopped early
+			pr.CloseWithError(fmt.Errorf("upload stopped: %v", errs[i]))
+		}(i, backend.(streamingBackend))
+	}
+
+	h := sha256.New()
+	size := &countWriter{}
+	out := []io.Writer{h, size}
+	for _, w := range writers {
+		if w != nil {
+			out = append(out, w)
+		}
+	}
+	if localWriter != nil {
+		out = append(out, localWriter)
+	}
+
+	startTime := time.Now()
+	err := withTimeout(ctx, uploadOperation, timeouts.Upload, func(ctx context.Context) error {
+		zipWriter := zip.NewWriter(io.MultiWriter(out...))
+		header := &zip.FileHeader{
+			// The same name as in archives written by CreateBackup, so restores find the snapshot
+			Name:     fmt.Sprintf("%s/%s", backupBaseDir, backupName),
+			Method:   zip.Deflate,
+			Modified: time.Unix(0, 0),
+		}
+		header.SetMode(0600)
+		entry, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := etcdSnapshot(ctx, etcdCACert, etcdCert, etcdKey, endpoints, entry); err != nil {
+			return err
+		}
+		stateFile := fmt.Sprintf("%s/%s.%s", k8sBaseDir, backupName, clusterStateExtension)
+		if _, err := os.Stat(stateFile); err == nil {
+			if err := AddFileToZip(zipWriter, stateFile); err != nil {
+				return err
+			}
+		}
+		return zipWriter.Close()
+	})
+	for _, pw := range pipes {
+		if pw != nil {
+			// Uploads of a failed snapshot are aborted instead of completed
+			pw.CloseWithError(err)
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return streamResult{}, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	for i, w := range writers {
+		if w == nil || errs[i] != nil {
+			continue
+		}
+		if w.err != nil {
+			errs[i] = w.err
+			continue
+		}
+		key := folderKey(targets[i], fmt.Sprintf("%s.%s", backupName, compressedExtension))
+		info, err := backends[i].Stat(key)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to stat uploaded snapshot: %v", err)
+		} else if info.Size != size.n {
+			errs[i] = fmt.Errorf("uploaded snapshot has size %d, expected %d", info.Size, size.n)
+		} else if cb, ok := backends[i].(checksumBackend); ok {
+			if err := cb.SetChecksum(key, sum); err != nil {
+				errs[i] = fmt.Errorf("failed to store checksum of uploaded snapshot: %v", err)
+			}
+		}
+	}
+	var localErr error
+	if localCopy {
+		if localWriter.err == nil {
+			localWriter.err = local.Close()
+		}
+		if localWriter.err != nil {
+			localErr = fmt.Errorf("failed to write local copy [%s]: %v", partialPath, localWriter.err)
+		}
+	}
+	log.WithFields(log.Fields{
+		"name":    backupName,
+		"size":    size.n,
+		"runtime": time.Since(startTime),
+	}).Info("Streamed backup to storage targets")
+	return streamResult{errs: errs, localErr: localErr, sum: sum}, nil
+}
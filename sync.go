@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var syncFlag = cli.BoolFlag{
+	Name:   "sync",
+	Usage:  "Upload local snapshots missing in a storage target, like a failed upload, after every rolling snapshot",
+	EnvVar: "SYNC",
+}
+
+var syncFlags = append(append([]cli.Flag{
+	cli.BoolFlag{
+		Name:   "debug",
+		Usage:  "Verbose logging information for debugging purposes",
+		EnvVar: "RANCHER_DEBUG",
+	},
+	cli.DurationFlag{
+		Name:  "retention",
+		Usage: "Retain backups within this time interval in hours",
+		Value: 24 * time.Hour,
+	},
+	cli.BoolFlag{
+		Name:  "download",
+		Usage: "Also download snapshots missing in /backup from the storage targets",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Only log the snapshots that would be uploaded or downloaded",
+	},
+	cli.BoolFlag{
+		Name:   "s3-backup",
+		Usage:  "Sync with the s3 target configured by the s3 flags",
+		EnvVar: "S3_BACKUP",
+	},
+	storageTargetsFlag,
+	clusterNameFlag,
+	adoptUnownedFlag,
+	clusterIDFlag,
+}, retentionFlags...), s3Flags...)
+
+// SyncAction reconciles /backup with every storage target
+func SyncAction(c *cli.Context) error {
+	SetLoggingLevel(c.Bool("debug"))
+
+	retentionPeriod := c.Duration("retention")
+	if retentionPeriod == 0 {
+		return fmt.Errorf("retention is not set")
+	}
+	policy, err := newRetentionPolicy(c, retentionPeriod)
+	if err != nil {
+		return err
+	}
+	localPolicy, err := localRetentionPolicy(c, policy)
+	if err != nil {
+		return err
+	}
+	targets, err := storageTargets(c, policy)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no storage target to sync with, set --s3-backup or --storage-targets")
+	}
+	setClusterOwner(targets, c.String("cluster-id"), c.String("cluster-name"))
+
+	queued, err := queuedFiles(uploadQueueFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the upload queue: %v", err)
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	var failed int
+	for _, target := range targets {
+		if err := syncTarget(ctx, now, target, localPolicy, queued, c.Bool("download"), c.Bool("dry-run")); err != nil {
+			log.Errorf("Failed to sync backup target [%s]: %v", target.Name, err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to sync %d of %d backup targets", failed, len(targets))
+	}
+	return nil
+}
+
+// syncTarget uploads the local snapshots missing in the target or stored there with a different size, and with
+// download also downloads the snapshots missing in /backup. Snapshots that the retention of the receiving side would
+// remove right away are skipped, unless they are pinned. Files in queued are left to the upload queue, which would
+// upload them again and add another version in versioned or locked buckets.
+func syncTarget(ctx context.Context, now time.Time, bc *backupConfig, localPolicy retentionPolicy, queued map[string]bool, download, dryRun bool) error {
+	backend, err := newStorageBackend(ctx, bc)
+	if err != nil {
+		return err
+	}
+	defer closeStorageBackend(backend)
+
+	files, err := os.ReadDir(backupBaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read backup directory: %v", err)
+	}
+	local := map[string]os.FileInfo{}
+	localNames := map[string]snapshotName{}
+	for _, file := range files {
+		n, err := parseSnapshotName(file.Name())
+		if file.IsDir() || err != nil {
+			continue
+		}
+		fi, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if n.Time.IsZero() {
+			n.Time = fi.ModTime()
+		}
+		local[file.Name()] = fi
+		localNames[n.Name] = n
+	}
+
+	prefix := ""
+	if len(bc.Folder) != 0 {
+		prefix = fmt.Sprintf("%s/", bc.Folder)
+	}
+	remote := map[string]objectInfo{}
+	remoteNames := map[string]snapshotName{}
+	markers := map[string]bool{}
+	err = backend.List(prefix, false, func(object objectInfo) error {
+		if strings.HasSuffix(object.Key, fmt.Sprintf(".%s", pinnedExtension)) {
+			markers[object.Key] = true
+			return nil
+		}
+		file := strings.TrimPrefix(object.Key, prefix)
+		n, err := parseSnapshotName(file)
+		if err != nil {
+			return nil
+		}
+		if n.Time.IsZero() {
+			n.Time = object.LastModified
+		}
+		remote[file] = object
+		remoteNames[n.Name] = n
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list backup target [%s]: %v", bc.Name, err)
+	}
+
+	var uploaded, downloaded, failed int
+	remoteExpired := expiredAfterSync(now, bc.Retention, remoteNames, localNames)
+	for _, file := range sortedKeys(local) {
+		fi := local[file]
+		n, _ := parseSnapshotName(file)
+		if !isCompressed(file) {
+			// Uploads are always compressed
+			continue
+		}
+		if object, ok := remote[file]; ok && object.Size == fi.Size() {
+			continue
+		}
+		if queued[file] {
+			log.WithFields(log.Fields{
+				"name":   file,
+				"target": bc.Name,
+			}).Debug("Skipping upload of snapshot queued for upload")
+			continue
+		}
+		if _, ok := remote[n.Name]; ok {
+			continue
+		}
+		if remoteExpired[n.Name] && !isLocalPinned(n.Name) {
+			log.WithFields(log.Fields{
+				"name":   file,
+				"target": bc.Name,
+			}).Debug("Skipping upload of snapshot expired by the retention of the target")
+			continue
+		}
+		if dryRun {
+			log.WithFields(log.Fields{
+				"name":   file,
+				"target": bc.Name,
+			}).Info("Would upload backup file")
+			continue
+		}
+		if err := syncUpload(ctx, backend, bc, file); err != nil {
+			log.Errorf("Failed to upload [%s] to backup target [%s]: %v", file, bc.Name, err)
+			failed++
+			continue
+		}
+		uploaded++
+	}
+
+	if download {
+		localExpired := expiredAfterSync(now, localPolicy, localNames, remoteNames)
+		var candidates []*snapshot
+		for _, file := range sortedKeys(remote) {
+			object := remote[file]
+			n, _ := parseSnapshotName(file)
+			if _, ok := localNames[n.Name]; ok {
+				continue
+			}
+			s := &snapshot{Name: n.Name, Time: n.Time, Size: object.Size, Keys: []string{object.Key}}
+			if localExpired[n.Name] {
+				pinned, err := isRemotePinned(backend, s, markers)
+				if err != nil || !pinned {
+					log.WithFields(log.Fields{
+						"name":   file,
+						"target": bc.Name,
+					}).Debug("Skipping download of snapshot expired by the local retention")
+					continue
+				}
+			}
+			candidates = append(candidates, s)
+		}
+		for _, s := range withoutForeign(backend, bc, candidates) {
+			object := remote[strings.TrimPrefix(s.Keys[0], prefix)]
+			if dryRun {
+				log.WithFields(log.Fields{
+					"name":   object.Key,
+					"target": bc.Name,
+				}).Info("Would download backup file")
+				continue
+			}
+			if err := syncDownload(ctx, backend, object); err != nil {
+				log.Errorf("Failed to download [%s] from backup target [%s]: %v", object.Key, bc.Name, err)
+				failed++
+				continue
+			}
+			downloaded++
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"target":     bc.Name,
+		"uploaded":   uploaded,
+		"downloaded": downloaded,
+		"failed":     failed,
+	}).Info("Finished syncing backup target")
+	if failed != 0 {
+		return fmt.Errorf("failed to sync %d backup files", failed)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expiredAfterSync returns the names of the recurring snapshots that policy would expire at a location holding both
+// the snapshots already there and the ones about to be copied to it
+func expiredAfterSync(now time.Time, policy retentionPolicy, names ...map[string]snapshotName) map[string]bool {
+	set := newSnapshotSet()
+	for _, m := range names {
+		for _, n := range m {
+			if _, ok := set.byName[n.Name]; ok || !n.recurring() {
+				continue
+			}
+			set.add(n, n.Name, 0)
+		}
+	}
+	// The size budget is left to the retention of the location, the sizes of both sides aren't comparable
+	policy.MaxBytes = 0
+	expired := map[string]bool{}
+	for _, s := range policy.expiredByGroup(now, set.snapshots) {
+		expired[s.Name] = true
+	}
+	return expired
+}
+
+// syncUpload uploads a local snapshot after verifying the archive. uploadBackupFile checks the size and checksum of the
+// uploaded object.
+func syncUpload(ctx context.Context, backend storageBackend, bc *backupConfig, file string) error {
+	filePath := fmt.Sprintf("%s/%s", backupBaseDir, file)
+	if err := verifyArchive(filePath); err != nil {
+		return err
+	}
+	if err := uploadBackupFile(ctx, backend, folderKey(bc, file), filePath, s3Retries); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"name":   file,
+		"target": bc.Name,
+	}).Info("Synced backup file to target")
+	return nil
+}
+
+// syncDownload downloads a remote snapshot to /backup, removing it again when its size, checksum or archive doesn't
+// check out
+func syncDownload(ctx context.Context, backend storageBackend, object objectInfo) error {
+	file := path.Base(object.Key)
+	filePath := fmt.Sprintf("%s/%s", backupBaseDir, file)
+	tmpPath := fmt.Sprintf("%s/.%s.sync", backupBaseDir, file)
+	defer os.Remove(tmpPath)
+
+	// downloadObject checks the size and checksum
+	if err := downloadObject(ctx, backend, object, tmpPath); err != nil {
+		return err
+	}
+	if isCompressed(file) {
+		if err := verifyArchive(tmpPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	log.Infof("Synced [%s] from backup target to [%s]", object.Key, filePath)
+	return nil
+}
+
+// verifyArchive reads every file in the snapshot archive, which checks their CRC-32 checksums
+func verifyArchive(filePath string) error {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive [%s]: %v", filePath, err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open [%s] in archive [%s]: %v", f.Name, filePath, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("archive [%s] is corrupt: %s: %v", filePath, f.Name, err)
+		}
+	}
+	return nil
+}
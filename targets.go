@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const defaultTargetName = "s3"
+
+var storageTargetsFlag = cli.StringFlag{
+	Name:   "storage-targets",
+	Usage:  "Specify additional storage targets as a JSON list. Can be a file path or a base64 string",
+	EnvVar: "STORAGE_TARGETS",
+}
+
+// storageTargetSpec is the JSON representation of a storage target, field names follow the s3 flags
+type storageTargetSpec struct {
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	Path             string `json:"path"`
+	Endpoint         string `json:"endpoint"`
+	AccessKey        string `json:"accessKey"`
+	SecretKey        string `json:"secretKey"`
+	BucketName       string `json:"bucketName"`
+	Region           string `json:"region"`
+	EndpointCA       string `json:"endpointCA"`
+	Folder           string `json:"folder"`
+	StorageClass     string `json:"storageClass"`
+	ObjectLockMode   string `json:"objectLockMode"`
+	ObjectLockPeriod string `json:"objectLockPeriod"`
+	Retention        string `json:"retention"`
+	MaxBytes         string `json:"maxBytes"`
+	KeepVersions     *int   `json:"keepVersions"`
+	Container        string `json:"container"`
+	AccountName      string `json:"accountName"`
+	AccountKey       string `json:"accountKey"`
+	SASToken         string `json:"sasToken"`
+	ClientID         string `json:"clientID"`
+	CredentialsJSON  string `json:"credentialsJSON"`
+	User             string `json:"user"`
+	PrivateKey       string `json:"privateKey"`
+	KnownHosts       string `json:"knownHosts"`
+}
+
+// storageTargets returns every target snapshots are uploaded to: the one configured with the s3 flags (if
+// s3-backup is set) followed by the ones in storage-targets. Targets without a retention use policy.
+func storageTargets(c *cli.Context, policy retentionPolicy) ([]*backupConfig, error) {
+	var targets []*backupConfig
+	bc := newBackupConfig(c)
+	if bc.Backup {
+		bc.Name = defaultTargetName
+		retention, err := parseRetentionPolicy(c.String("s3-retention"), policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3-retention: %v", err)
+		}
+		if retention.MaxBytes, err = parseByteSize(c.String("s3-max-bytes")); err != nil {
+			return nil, fmt.Errorf("invalid s3-max-bytes: %v", err)
+		}
+		bc.Retention = retention
+		targets = append(targets, bc)
+	}
+
+	specs, err := readStorageTargets(c.String("storage-targets"))
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		target, err := spec.backupConfig()
+		if err != nil {
+			return nil, err
+		}
+		if spec.KeepVersions == nil {
+			target.KeepVersions = keepVersions(c)
+		}
+		target.AdoptUnowned = c.Bool("adopt-unowned")
+		if target.Retention, err = parseRetentionPolicy(spec.Retention, policy); err != nil {
+			return nil, fmt.Errorf("storage target [%s]: invalid retention: %v", spec.Name, err)
+		}
+		if target.Retention.MaxBytes, err = parseByteSize(spec.MaxBytes); err != nil {
+			return nil, fmt.Errorf("storage target [%s]: invalid maxBytes: %v", spec.Name, err)
+		}
+		targets = append(targets, target)
+	}
+
+	names := map[string]bool{}
+	for _, target := range targets {
+		if names[target.Name] {
+			return nil, fmt.Errorf("duplicate storage target name [%s]", target.Name)
+		}
+		names[target.Name] = true
+		if err := setObjectLockPeriod(target, target.Retention); err != nil {
+			return nil, fmt.Errorf("storage target [%s]: %v", target.Name, err)
+		}
+	}
+	return targets, nil
+}
+
+func readStorageTargets(value string) ([]storageTargetSpec, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	data, err := readFileOrBase64(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage targets: %v", err)
+	}
+	var specs []storageTargetSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse storage targets: %v", err)
+	}
+	return specs, nil
+}
+
+func (s storageTargetSpec) backupConfig() (*backupConfig, error) {
+	if len(s.Name) == 0 {
+		return nil, fmt.Errorf("storage target name is required")
+	}
+	switch s.Type {
+	case "", s3StorageType, gcsStorageType:
+		if len(s.BucketName) == 0 {
+			return nil, fmt.Errorf("storage target [%s]: bucketName is required", s.Name)
+		}
+	case filesystemStorageType:
+		if len(s.Path) == 0 {
+			return nil, fmt.Errorf("storage target [%s]: path is required", s.Name)
+		}
+	case sftpStorageType:
+		if len(s.Endpoint) == 0 || len(s.User) == 0 {
+			return nil, fmt.Errorf("storage target [%s]: endpoint and user are required", s.Name)
+		}
+	case azureStorageType:
+		if len(s.Container) == 0 {
+			return nil, fmt.Errorf("storage target [%s]: container is required", s.Name)
+		}
+		s.BucketName = s.Container
+	default:
+		return nil, fmt.Errorf("storage target [%s]: unknown type [%s]", s.Name, s.Type)
+	}
+	bc := &backupConfig{
+		Name:            s.Name,
+		Type:            s.Type,
+		Path:            s.Path,
+		Backup:          true,
+		Endpoint:        s.Endpoint,
+		AccessKey:       s.AccessKey,
+		SecretKey:       s.SecretKey,
+		BucketName:      s.BucketName,
+		Region:          s.Region,
+		EndpointCA:      s.EndpointCA,
+		Folder:          s.Folder,
+		StorageClass:    s.StorageClass,
+		LockMode:        s.ObjectLockMode,
+		AccountName:     s.AccountName,
+		AccountKey:      s.AccountKey,
+		SASToken:        s.SASToken,
+		ClientID:        s.ClientID,
+		CredentialsJSON: s.CredentialsJSON,
+		User:            s.User,
+		PrivateKey:      s.PrivateKey,
+		KnownHosts:      s.KnownHosts,
+		KeepVersions:    -1,
+	}
+	if s.KeepVersions != nil {
+		bc.KeepVersions = *s.KeepVersions
+	}
+	var err error
+	if len(s.ObjectLockPeriod) != 0 {
+		if bc.LockPeriod, err = time.ParseDuration(s.ObjectLockPeriod); err != nil {
+			return nil, fmt.Errorf("storage target [%s]: invalid objectLockPeriod: %v", s.Name, err)
+		}
+	}
+	return bc, nil
+}
+
+// uploadToTargets uploads the snapshot to all targets in parallel. The returned errors are indexed like targets,
+// a failing target doesn't stop the upload to the others.
+func uploadToTargets(ctx context.Context, backupName, compressedFilePath string, targets []*backupConfig) []error {
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target *backupConfig) {
+			defer wg.Done()
+			errs[i] = CreateS3Backup(ctx, backupName, compressedFilePath, target)
+			if errs[i] != nil {
+				log.WithFields(log.Fields{
+					"name":   backupName,
+					"target": target.Name,
+					"error":  errs[i],
+				}).Error("Failed to upload snapshot to storage target")
+			}
+		}(i, target)
+	}
+	wg.Wait()
+	return errs
+}
+
+func targetsError(targets []*backupConfig, errs []error) error {
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", targets[i].Name, err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed to upload snapshot to %d of %d storage targets: %s", len(failed), len(targets), strings.Join(failed, "; "))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	etcdOperation     = "etcd"
+	snapshotOperation = "snapshot"
+	kubectlOperation  = "kubectl"
+	uploadOperation   = "upload"
+	downloadOperation = "download"
+	requestOperation  = "request"
+)
+
+// operationTimeouts limit how long each kind of external call may take, so a hung endpoint can't freeze the rolling
+// snapshots. A timeout of 0 disables it.
+type operationTimeouts struct {
+	// Etcd covers etcdctl calls other than snapshot save
+	Etcd time.Duration
+	// Snapshot, Upload and Download take longer the larger the database and the slower the link, so they have no
+	// limit by default
+	Snapshot time.Duration
+	Kubectl  time.Duration
+	Upload   time.Duration
+	Download time.Duration
+	// Request covers the other storage calls, like stat, delete and each page of a listing. SFTP listings have no
+	// pages, so it covers them as a whole.
+	Request time.Duration
+}
+
+var timeouts = operationTimeouts{
+	Etcd:    30 * time.Second,
+	Kubectl: time.Minute,
+	Request: 10 * time.Minute,
+}
+
+var etcdTimeoutFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:        "etcd-timeout",
+		Usage:       "Timeout of etcdctl health and status checks",
+		EnvVar:      "ETCD_TIMEOUT",
+		Value:       timeouts.Etcd,
+		Destination: &timeouts.Etcd,
+	},
+	cli.DurationFlag{
+		Name:        "snapshot-timeout",
+		Usage:       "Timeout of taking an etcd snapshot, no limit by default",
+		EnvVar:      "SNAPSHOT_TIMEOUT",
+		Value:       timeouts.Snapshot,
+		Destination: &timeouts.Snapshot,
+	},
+	cli.DurationFlag{
+		Name:        "kubectl-timeout",
+		Usage:       "Timeout of retrieving the cluster state with kubectl",
+		EnvVar:      "KUBECTL_TIMEOUT",
+		Value:       timeouts.Kubectl,
+		Destination: &timeouts.Kubectl,
+	},
+}
+
+var storageTimeoutFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:        "upload-timeout",
+		Usage:       "Timeout of uploading a snapshot to a storage target, no limit by default",
+		EnvVar:      "UPLOAD_TIMEOUT",
+		Value:       timeouts.Upload,
+		Destination: &timeouts.Upload,
+	},
+	cli.DurationFlag{
+		Name:        "download-timeout",
+		Usage:       "Timeout of downloading a snapshot, no limit by default",
+		EnvVar:      "DOWNLOAD_TIMEOUT",
+		Value:       timeouts.Download,
+		Destination: &timeouts.Download,
+	},
+	cli.DurationFlag{
+		Name:        "request-timeout",
+		Usage:       "Timeout of other requests to a storage target, like stat, delete and each page of a listing",
+		EnvVar:      "REQUEST_TIMEOUT",
+		Value:       timeouts.Request,
+		Destination: &timeouts.Request,
+	},
+}
+
+// timeoutError is returned when an operation didn't finish within its timeout
+type timeoutError struct {
+	Op      string
+	Timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Op, e.Timeout)
+}
+
+func isTimeout(err error) bool {
+	var t *timeoutError
+	return errors.As(err, &t)
+}
+
+// withTimeout calls fn with a context that expires after timeout. When it expires before fn returns, the error of fn
+// is replaced by a timeoutError, which is also counted in the metrics.
+func withTimeout(ctx context.Context, op string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		operationTimeoutsTotal.WithLabelValues(op).Inc()
+		return &timeoutError{Op: op, Timeout: timeout}
+	}
+	return err
+}
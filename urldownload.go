@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	partialExtension = "part"
+	// validatorExtension is the file next to a partial download that holds the ETag or Last-Modified date of the file
+	// the download started from
+	validatorExtension = "validator"
+)
+
+var urlDownloadFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "url",
+		Usage:  "Download the snapshot from this HTTPS or presigned URL",
+		EnvVar: "SNAPSHOT_URL",
+	},
+	cli.StringFlag{
+		Name:   "url-ca",
+		Usage:  "Specify custom CA for the snapshot URL. Can be a file path or a base64 string",
+		EnvVar: "SNAPSHOT_URL_CA",
+	},
+	cli.StringFlag{
+		Name:   "url-bearer-token",
+		Usage:  "Bearer token to send with requests to the snapshot URL",
+		EnvVar: "SNAPSHOT_URL_BEARER_TOKEN",
+	},
+	cli.StringFlag{
+		Name:   "url-username",
+		Usage:  "Username for basic authentication to the snapshot URL",
+		EnvVar: "SNAPSHOT_URL_USERNAME",
+	},
+	cli.StringFlag{
+		Name:   "url-password",
+		Usage:  "Password for basic authentication to the snapshot URL",
+		EnvVar: "SNAPSHOT_URL_PASSWORD",
+	},
+	cli.BoolFlag{
+		Name:   "url-allow-insecure",
+		Usage:  "Send the bearer token or basic authentication to plain http URLs and redirects too",
+		EnvVar: "SNAPSHOT_URL_ALLOW_INSECURE",
+	},
+	cli.StringFlag{
+		Name:  "url-checksum",
+		Usage: "Expected SHA-256 checksum of the file at the snapshot URL",
+	},
+	cli.StringFlag{
+		Name:  "url-checksum-url",
+		Usage: "URL of a checksum sidecar file or a sha256sum style manifest to verify the snapshot against",
+	},
+}
+
+// urlDownloader fetches files over HTTP(S) with the configured CA and authentication
+type urlDownloader struct {
+	client        *http.Client
+	token         string
+	username      string
+	password      string
+	allowInsecure bool
+}
+
+func DownloadURLBackup(c *cli.Context) error {
+	snapshotURL := c.String("url")
+	u, err := url.Parse(snapshotURL)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot url: %v", err)
+	}
+	// Presigned URLs carry the object key in the path, prefer that over the name as it includes the extension
+	filename := path.Base(u.Path)
+	if filename == "." || filename == "/" {
+		filename = path.Base(c.String("name"))
+	}
+	if filename == "." || filename == "/" {
+		return fmt.Errorf("snapshot name is required when the url has no file name")
+	}
+
+	d := &urlDownloader{
+		client:        &http.Client{},
+		token:         c.String("url-bearer-token"),
+		username:      c.String("url-username"),
+		password:      c.String("url-password"),
+		allowInsecure: c.Bool("url-allow-insecure"),
+	}
+	d.client.CheckRedirect = d.checkRedirect
+	if ca := c.String("url-ca"); len(ca) != 0 {
+		tr, err := setTransportCA(http.DefaultTransport, ca)
+		if err != nil {
+			return err
+		}
+		d.client.Transport = tr
+	}
+
+	ctx := context.Background()
+	checksum := strings.ToLower(c.String("url-checksum"))
+	if checksumURL := c.String("url-checksum-url"); len(checksum) == 0 && len(checksumURL) != 0 {
+		if checksum, err = d.fetchChecksum(ctx, checksumURL, filename); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Trying to download backup file from: %s", u.Redacted())
+	targetFileLocation := fmt.Sprintf("%s/%s", backupBaseDir, filename)
+	partialFileLocation := fmt.Sprintf("%s.%s", targetFileLocation, partialExtension)
+	err = retry(ctx, downloadOperation, defaultS3Retries, func(uint) error {
+		return withTimeout(ctx, downloadOperation, timeouts.Download, func(ctx context.Context) error {
+			return d.download(ctx, snapshotURL, partialFileLocation)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to download backup file for [%s]: %v", filename, err)
+	}
+	os.Remove(validatorPath(partialFileLocation))
+
+	if len(checksum) == 0 {
+		log.Warnf("No checksum given for [%s], skipping verification", filename)
+	} else if err := verifyChecksum(partialFileLocation, checksum); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partialFileLocation, targetFileLocation); err != nil {
+		return err
+	}
+	if err := os.Chmod(targetFileLocation, 0600); err != nil {
+		return fmt.Errorf("changing permission of the locally downloaded snapshot failed")
+	}
+	log.Infof("Successfully downloaded [%s]", filename)
+
+	return decompressDownloadedBackup(filename)
+}
+
+// get requests rawURL from offset on, if the file still matches validator
+func (d *urlDownloader) get(ctx context.Context, rawURL string, offset int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkScheme(req.URL); err != nil {
+		return nil, err
+	}
+	if len(d.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	} else if len(d.username) != 0 {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// The server sends the whole file instead of the range if it changed
+		req.Header.Set("If-Range", validator)
+	}
+	return d.client.Do(req)
+}
+
+// checkScheme refuses to send credentials unencrypted, unless allowInsecure is set
+func (d *urlDownloader) checkScheme(u *url.URL) error {
+	if (len(d.token) == 0 && len(d.username) == 0) || u.Scheme == "https" || d.allowInsecure {
+		return nil
+	}
+	return permanent(fmt.Errorf("refusing to send credentials to %s over %s, use https or set --url-allow-insecure", u.Redacted(), u.Scheme))
+}
+
+// checkRedirect keeps the default limit of 10 redirects and refuses redirects that would send the credentials
+// unencrypted, like from https to http
+func (d *urlDownloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return d.checkScheme(req.URL)
+}
+
+// download writes the file at rawURL to filePath. If filePath already holds the start of the same file from an
+// interrupted attempt, only the remainder is requested.
+func (d *urlDownloader) download(ctx context.Context, rawURL, filePath string) error {
+	var offset int64
+	var validator string
+	if fi, err := os.Stat(filePath); err == nil {
+		// Without a validator there's no telling which file the partial file is the start of
+		if data, err := os.ReadFile(validatorPath(filePath)); err == nil && len(data) != 0 {
+			offset = fi.Size()
+			validator = string(data)
+		}
+	}
+	resp, err := d.get(ctx, rawURL, offset, validator)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The file changed or the server ignored the range, start over
+		flags |= os.O_TRUNC
+		if err := saveValidator(validatorPath(filePath), resp.Header); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(filePath)
+			os.Remove(validatorPath(filePath))
+			return fmt.Errorf("unexpected range %s in response, starting over", resp.Header.Get("Content-Range"))
+		}
+		log.Infof("Resuming download at byte %d", offset)
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is longer than the file, it doesn't match anymore
+		os.Remove(filePath)
+		os.Remove(validatorPath(filePath))
+		return fmt.Errorf("partial download [%s] doesn't match the file at the url, starting over", filePath)
+	default:
+		return &statusError{Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	f, err := os.OpenFile(filePath, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+func validatorPath(filePath string) string {
+	return fmt.Sprintf("%s.%s", filePath, validatorExtension)
+}
+
+// saveValidator stores the ETag, or the Last-Modified date for weak or missing ETags, of the file a download starts
+// from. If-Range only takes strong validators.
+func saveValidator(filePath string, header http.Header) error {
+	validator := header.Get("ETag")
+	if len(validator) == 0 || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if len(validator) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(filePath, []byte(validator), 0600)
+}
+
+// fetchChecksum reads the checksum of filename from a sidecar file holding a single checksum, or from a
+// manifest in sha256sum format. It is retried like the download.
+func (d *urlDownloader) fetchChecksum(ctx context.Context, rawURL, filename string) (string, error) {
+	var data []byte
+	err := retry(ctx, requestOperation, defaultS3Retries, func(uint) error {
+		return withTimeout(ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+			resp, err := d.get(ctx, rawURL, 0, "")
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return &statusError{Status: resp.Status, StatusCode: resp.StatusCode}
+			}
+			data, err = io.ReadAll(resp.Body)
+			return err
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksum: %v", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1:
+			return strings.ToLower(fields[0]), nil
+		case len(fields) == 2 && path.Base(strings.TrimPrefix(fields[1], "*")) == filename:
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum found for [%s] in %s", filename, rawURL)
+}
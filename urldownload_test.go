@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var urlTestContent = []byte(strings.Repeat("etcd snapshot ", 1000))
+
+// serveSnapshot serves content with etag and records the requests
+func serveSnapshot(content []byte, etag string, requests *[]*http.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "snapshot.zip", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// writePartial writes the start of a download and its validator
+func writePartial(t *testing.T, data []byte, validator string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "snapshot.zip."+partialExtension)
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(validatorPath(filePath), []byte(validator), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestURLDownloadResume(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		partial   []byte
+		validator string
+		status    int
+		err       bool
+	}{
+		{name: "new download", status: http.StatusOK},
+		{name: "resume", partial: urlTestContent[:100], validator: `"v1"`, status: http.StatusPartialContent},
+		// If-Range doesn't match, the server sends the whole file
+		{name: "changed file", partial: []byte("old file"), validator: `"v0"`, status: http.StatusOK},
+		// The partial file is longer than the file, it is removed and the next attempt starts over
+		{name: "longer partial file", partial: append(bytes.Clone(urlTestContent), "more"...), validator: `"v1"`,
+			status: http.StatusRequestedRangeNotSatisfiable, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests []*http.Request
+			srv := httptest.NewServer(serveSnapshot(urlTestContent, `"v1"`, &requests))
+			defer srv.Close()
+
+			filePath := filepath.Join(t.TempDir(), "snapshot.zip."+partialExtension)
+			if tc.partial != nil {
+				filePath = writePartial(t, tc.partial, tc.validator)
+			}
+			d := &urlDownloader{client: srv.Client()}
+			err := d.download(context.Background(), srv.URL+"/snapshot.zip", filePath)
+			if len(requests) != 1 {
+				t.Fatalf("download sent %d requests, expected 1", len(requests))
+			}
+			if tc.partial != nil {
+				if r := requests[0].Header.Get("Range"); r != "bytes="+strconv.Itoa(len(tc.partial))+"-" {
+					t.Errorf("download requested range %q", r)
+				}
+				if r := requests[0].Header.Get("If-Range"); r != tc.validator {
+					t.Errorf("download sent If-Range %q, expected %q", r, tc.validator)
+				}
+			}
+			if tc.err {
+				if err == nil {
+					t.Fatalf("download with status %d succeeded", tc.status)
+				}
+				for _, p := range []string{filePath, validatorPath(filePath)} {
+					if _, err := os.Stat(p); !os.IsNotExist(err) {
+						t.Errorf("%s was left behind: %v", p, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if data, _ := os.ReadFile(filePath); !bytes.Equal(data, urlTestContent) {
+				t.Errorf("downloaded %d bytes that don't match the file", len(data))
+			}
+			if data, _ := os.ReadFile(validatorPath(filePath)); string(data) != `"v1"` {
+				t.Errorf("validator is %q, expected %q", data, `"v1"`)
+			}
+		})
+	}
+}
+
+// TestURLDownloadUnexpectedRange starts over when the server sends another range than requested
+func TestURLDownloadUnexpectedRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-9/100")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(urlTestContent[:10])
+	}))
+	defer srv.Close()
+
+	filePath := writePartial(t, urlTestContent[:50], `"v1"`)
+	d := &urlDownloader{client: srv.Client()}
+	if err := d.download(context.Background(), srv.URL, filePath); err == nil {
+		t.Fatal("download with an unexpected range succeeded")
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("partial file was left behind: %v", err)
+	}
+}
+
+func TestURLDownloadCredentials(t *testing.T) {
+	var requests []*http.Request
+	httpSrv := httptest.NewServer(serveSnapshot(urlTestContent, `"v1"`, &requests))
+	defer httpSrv.Close()
+	httpsSrv := httptest.NewTLSServer(serveSnapshot(urlTestContent, `"v1"`, &requests))
+	defer httpsSrv.Close()
+	// Redirects from https to the plain http server
+	redirectSrv := httptest.NewTLSServer(http.RedirectHandler(httpSrv.URL, http.StatusFound))
+	defer redirectSrv.Close()
+
+	for _, tc := range []struct {
+		name          string
+		url           string
+		token         string
+		allowInsecure bool
+		err           bool
+	}{
+		{name: "https", url: httpsSrv.URL, token: "secret"},
+		{name: "http without credentials", url: httpSrv.URL},
+		{name: "http", url: httpSrv.URL, token: "secret", err: true},
+		{name: "http allowed", url: httpSrv.URL, token: "secret", allowInsecure: true},
+		{name: "redirect to http", url: redirectSrv.URL, token: "secret", err: true},
+		{name: "redirect to http allowed", url: redirectSrv.URL, token: "secret", allowInsecure: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = nil
+			d := &urlDownloader{client: httpsSrv.Client(), token: tc.token, allowInsecure: tc.allowInsecure}
+			d.client.CheckRedirect = d.checkRedirect
+			filePath := filepath.Join(t.TempDir(), "snapshot.zip")
+			err := d.download(context.Background(), tc.url, filePath)
+			if tc.err {
+				if err == nil || isRetryable(err) {
+					t.Errorf("download returned %v, expected a permanent error", err)
+				}
+				if len(requests) != 0 {
+					t.Errorf("%d requests with credentials reached the http server", len(requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			expected := ""
+			if len(tc.token) != 0 {
+				expected = "Bearer " + tc.token
+			}
+			if len(requests) != 1 || requests[0].Header.Get("Authorization") != expected {
+				t.Errorf("server received %d requests, expected one with Authorization %q", len(requests), expected)
+			}
+		})
+	}
+}
+
+func TestURLFetchChecksum(t *testing.T) {
+	defer func(b retryBackoffConfig) { retryBackoff = b }(retryBackoff)
+	retryBackoff = retryBackoffConfig{Initial: time.Millisecond, Max: time.Millisecond}
+
+	manifest := "0123abcd  other.zip\nABCDEF01  *snapshot.zip\n"
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		checksum string
+		attempts int
+	}{
+		{name: "manifest", statuses: []int{http.StatusOK}, checksum: "abcdef01", attempts: 1},
+		{name: "server error is retried", statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, checksum: "abcdef01", attempts: 2},
+		{name: "not found", statuses: []int{http.StatusNotFound}, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tc.statuses[attempts]
+				attempts++
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write([]byte(manifest))
+				}
+			}))
+			defer srv.Close()
+
+			d := &urlDownloader{client: srv.Client()}
+			checksum, err := d.fetchChecksum(context.Background(), srv.URL, "snapshot.zip")
+			if len(tc.checksum) != 0 && err != nil {
+				t.Fatalf("fetchChecksum: %v", err)
+			}
+			if len(tc.checksum) == 0 && err == nil {
+				t.Fatalf("fetchChecksum returned %q, expected an error", checksum)
+			}
+			if checksum != tc.checksum {
+				t.Errorf("fetchChecksum returned %q, expected %q", checksum, tc.checksum)
+			}
+			if attempts != tc.attempts {
+				t.Errorf("fetchChecksum made %d requests, expected %d", attempts, tc.attempts)
+			}
+		})
+	}
+}
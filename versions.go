@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var keepVersionsFlag = cli.IntFlag{
+	Name:   "keep-versions",
+	Usage:  "On versioned buckets, also remove noncurrent versions of deleted snapshots, keeping the newest N",
+	EnvVar: "KEEP_VERSIONS",
+}
+
+// objectVersion is a version of an object in a versioned bucket, or its delete marker
+type objectVersion struct {
+	Key          string
+	VersionID    string
+	Size         int64
+	LastModified time.Time
+	IsLatest     bool
+	DeleteMarker bool
+}
+
+// versionListingBackend is implemented by backends that can list and remove the versions of an object
+type versionListingBackend interface {
+	// ListVersions calls fn for every version of every object with a key starting with prefix, newest first per key
+	ListVersions(prefix string, fn func(objectVersion) error) error
+	// DeleteVersions removes the versions and returns the error of every version that couldn't be removed
+	DeleteVersions(versions []objectVersion) map[objectVersion]error
+}
+
+// keepVersions returns the number of noncurrent versions to keep, or -1 when they shouldn't be removed
+func keepVersions(c *cli.Context) int {
+	if !c.IsSet("keep-versions") {
+		return -1
+	}
+	return c.Int("keep-versions")
+}
+
+// pruneVersions removes the noncurrent versions of the deleted keys, except for the newest keep ones. When none are
+// kept, the delete marker is removed as well so nothing of the object remains.
+func pruneVersions(backend storageBackend, bc *backupConfig, keys []string, keep int) {
+	vb, ok := backend.(versionListingBackend)
+	if !ok || keep < 0 || len(keys) == 0 {
+		return
+	}
+	var removed, failed int
+	for _, key := range keys {
+		var versions []objectVersion
+		err := vb.ListVersions(key, func(v objectVersion) error {
+			// The prefix also matches longer keys
+			if v.Key == key {
+				versions = append(versions, v)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Error detected while listing versions of [%s]: %v", key, err)
+			continue
+		}
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].LastModified.After(versions[j].LastModified)
+		})
+
+		var toDelete []objectVersion
+		var marker *objectVersion
+		exists := false
+		kept := 0
+		for i, v := range versions {
+			switch {
+			case v.IsLatest && v.DeleteMarker:
+				marker = &versions[i]
+			case v.IsLatest:
+				exists = true
+			case !v.DeleteMarker && kept < keep:
+				kept++
+			default:
+				toDelete = append(toDelete, v)
+			}
+		}
+		// Leave objects that were not deleted alone
+		if exists || (len(toDelete) == 0 && (keep != 0 || marker == nil)) {
+			continue
+		}
+		errs := vb.DeleteVersions(toDelete)
+		removed += len(toDelete)
+		failed += len(errs)
+		for v, err := range errs {
+			log.Errorf("Error detected during deletion of version [%s] of [%s]: %v", v.VersionID, v.Key, err)
+		}
+		// Removing the delete marker before the versions below it would restore the object
+		if keep == 0 && marker != nil && len(errs) == 0 {
+			removed++
+			for v, err := range vb.DeleteVersions([]objectVersion{*marker}) {
+				log.Errorf("Error detected during deletion of delete marker [%s] of [%s]: %v", v.VersionID, v.Key, err)
+				failed++
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"target":  bc.Name,
+		"keep":    keep,
+		"deleted": removed - failed,
+		"failed":  failed,
+	}).Info("Finished deleting noncurrent versions of s3 backup files")
+}
+
+// ListVersions applies the request timeout to each wait for the next version like List, so the versions of large
+// buckets can be listed
+func (s *s3Backend) ListVersions(prefix string, fn func(objectVersion) error) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	objectCh := s.client.ListObjects(ctx, s.bc.BucketName, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    true,
+		WithVersions: true,
+	})
+	for {
+		object, ok, err := nextObject(ctx, objectCh)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if object.Err != nil {
+			return object.Err
+		}
+		err = fn(objectVersion{
+			Key:          object.Key,
+			VersionID:    object.VersionID,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+			IsLatest:     object.IsLatest,
+			DeleteMarker: object.IsDeleteMarker,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *s3Backend) DeleteVersions(versions []objectVersion) map[objectVersion]error {
+	byID := map[string]objectVersion{}
+	for _, v := range versions {
+		byID[fmt.Sprintf("%s/%s", v.Key, v.VersionID)] = v
+	}
+	errs := map[objectVersion]error{}
+	err := withTimeout(s.ctx, requestOperation, timeouts.Request, func(ctx context.Context) error {
+		objectsCh := make(chan minio.ObjectInfo)
+		go func() {
+			defer close(objectsCh)
+			for _, v := range versions {
+				select {
+				case objectsCh <- minio.ObjectInfo{Key: v.Key, VersionID: v.VersionID}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		for rErr := range s.client.RemoveObjects(ctx, s.bc.BucketName, objectsCh, minio.RemoveObjectsOptions{}) {
+			errs[byID[fmt.Sprintf("%s/%s", rErr.ObjectName, rErr.VersionID)]] = rErr.Err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		// Versions whose result didn't arrive in time may or may not be removed
+		for _, v := range versions {
+			if _, ok := errs[v]; !ok {
+				errs[v] = err
+			}
+		}
+	}
+	return errs
+}